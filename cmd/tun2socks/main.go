@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/eycorsican/go-tun2socks/common/acl"
 	"github.com/eycorsican/go-tun2socks/common/dns/blocker"
 	"github.com/eycorsican/go-tun2socks/common/log"
 	_ "github.com/eycorsican/go-tun2socks/common/log/simple" // Register a simple logger.
@@ -33,21 +35,46 @@ func addPostFlagsInitFn(fn func()) {
 }
 
 type CmdArgs struct {
-	Version         *bool
-	TunName         *string
-	TunAddr         *string
-	TunGw           *string
-	TunMask         *string
-	TunDns          *string
-	TunPersist      *bool
-	BlockOutsideDns *bool
-	ProxyType       *string
-	ProxyServer     *string
-	ProxyHost       *string
-	ProxyPort       *uint16
-	UdpTimeout      *time.Duration
-	LogLevel        *string
-	DnsFallback     *bool
+	Version           *bool
+	TunName           *string
+	TunAddr           *string
+	TunGw             *string
+	TunMask           *string
+	TunDns            *string
+	TunPersist        *bool
+	TunQueues         *int
+	TunMtu            *int
+	TcpWindow         *int
+	TcpSendBuffer     *int
+	TcpMaxConns       *int
+	TcpMaxConnsSrc    *int
+	TcpMaxConnsDst    *int
+	UdpMaxSessions    *int
+	UdpMaxSessionsSrc *int
+	UdpMaxSessionsDst *int
+	TcpDeferHandshake *bool
+	UdpUnreachable    *bool
+	DialTimeout       *time.Duration
+	ACL               *string
+	RateLimit         *int64
+	RateLimitSource   *int64
+	RateLimitDest     *int64
+	RateLimitConn     *int64
+	TunOffload        *bool
+	BlockOutsideDns   *bool
+	ProxyType         *string
+	ProxyServer       *string
+	ProxyHost         *string
+	ProxyPort         *uint16
+	UdpTimeout        *time.Duration
+	ProxyStrategy     *string
+	ProbeTarget       *string
+	ProbeInterval     *time.Duration
+	ShutdownTimeout   *time.Duration
+	Middlewares       *string
+	MetricsInterval   *time.Duration
+	LogLevel          *string
+	DnsFallback       *bool
 }
 
 type cmdFlag uint
@@ -55,12 +82,13 @@ type cmdFlag uint
 const (
 	fProxyServer cmdFlag = iota
 	fUdpTimeout
+	fProxyGroup
 )
 
 var flagCreaters = map[cmdFlag]func(){
 	fProxyServer: func() {
 		if args.ProxyServer == nil {
-			args.ProxyServer = flag.String("proxyServer", "1.2.3.4:1087", "Proxy server address")
+			args.ProxyServer = flag.String("proxyServer", "1.2.3.4:1087", "Proxy server address, several comma-separated socks servers make a group")
 		}
 	},
 	fUdpTimeout: func() {
@@ -68,6 +96,13 @@ var flagCreaters = map[cmdFlag]func(){
 			args.UdpTimeout = flag.Duration("udpTimeout", 1*time.Minute, "UDP session timeout")
 		}
 	},
+	fProxyGroup: func() {
+		if args.ProxyStrategy == nil {
+			args.ProxyStrategy = flag.String("proxyStrategy", "failover", "Strategy choosing among several proxy servers: failover, round-robin or lowest-latency")
+			args.ProbeTarget = flag.String("probeTarget", "www.google.com:443", "Address connected through each proxy server to check its health")
+			args.ProbeInterval = flag.Duration("probeInterval", 30*time.Second, "Interval of proxy server health checks, 0 to disable")
+		}
+	},
 }
 
 func (a *CmdArgs) addFlag(f cmdFlag) {
@@ -80,12 +115,124 @@ func (a *CmdArgs) addFlag(f cmdFlag) {
 
 var args = new(CmdArgs)
 
-var lwipWriter io.Writer
-
 const (
-	MTU = 1500
+	// Maximum number of packets passed to the stack in a single batch.
+	maxBatchSize = 64
+
+	// Maximum number of segments a TCP super-segment read from a TUN
+	// device with offloads enabled can be split into.
+	maxGSOSegments = 128
 )
 
+// pumpPackets reads packets from dev and writes them to the stack in
+// batches. Reading is done in a separate goroutine, packets accumulated
+// while the stack is busy are written in a single call.
+func pumpPackets(dev io.Reader, stack core.LWIPStack, mtu int) error {
+	free := make(chan []byte, 2*maxBatchSize)
+	for i := 0; i < cap(free); i++ {
+		free <- make([]byte, mtu)
+	}
+	ready := make(chan []byte, cap(free))
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(ready)
+		for {
+			buf := <-free
+			n, err := dev.Read(buf[:cap(buf)])
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if n == 0 {
+				free <- buf
+				continue
+			}
+			ready <- buf[:n]
+		}
+	}()
+
+	batch := make([][]byte, 0, maxBatchSize)
+	for pkt := range ready {
+		batch = append(batch[:0], pkt)
+	Collect:
+		for len(batch) < maxBatchSize {
+			select {
+			case pkt, ok := <-ready:
+				if !ok {
+					break Collect
+				}
+				batch = append(batch, pkt)
+			default:
+				break Collect
+			}
+		}
+		stack.WriteBatch(batch)
+		for _, pkt := range batch {
+			free <- pkt
+		}
+	}
+	return <-readErr
+}
+
+// pumpOffloadPackets reads packets prefixed with a virtio-net header from
+// dev, splits TCP super-segments and writes the resulting segments to the
+// stack in a single batch.
+func pumpOffloadPackets(dev io.Reader, stack core.LWIPStack, mtu int) error {
+	frame := make([]byte, core.VirtioNetHdrLen+65535)
+	segs := make([][]byte, maxGSOSegments)
+	for i := range segs {
+		segs[i] = make([]byte, mtu)
+	}
+	for {
+		n, err := dev.Read(frame)
+		if err != nil {
+			return err
+		}
+		for i := range segs {
+			segs[i] = segs[i][:cap(segs[i])]
+		}
+		nsegs, err := core.SplitGSO(frame[:n], segs)
+		if err != nil {
+			log.Debugf("dropping packet: %v", err)
+			continue
+		}
+		stack.WriteBatch(segs[:nsegs])
+	}
+}
+
+// useMiddlewares wraps the registered handlers with the comma-separated
+// list of middlewares.
+func useMiddlewares(names string) {
+	var tcpMws []core.TCPMiddleware
+	var udpMws []core.UDPMiddleware
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "recover":
+			tcpMws = append(tcpMws, core.RecoverTCP())
+			udpMws = append(udpMws, core.RecoverUDP())
+		case "log":
+			tcpMws = append(tcpMws, core.LogTCP())
+			udpMws = append(udpMws, core.LogUDP())
+		case "metrics":
+			m := new(core.Metrics)
+			tcpMws = append(tcpMws, core.MetricsTCP(m))
+			udpMws = append(udpMws, core.MetricsUDP(m))
+			if *args.MetricsInterval > 0 {
+				go func() {
+					for range time.Tick(*args.MetricsInterval) {
+						log.Infof("metrics: %v", m)
+					}
+				}()
+			}
+		default:
+			log.Fatalf("unknown middleware %v", name)
+		}
+	}
+	core.UseTCPMiddleware(tcpMws...)
+	core.UseUDPMiddleware(udpMws...)
+}
+
 func main() {
 	args.Version = flag.Bool("version", false, "Print version")
 	args.TunName = flag.String("tunName", "tun1", "TUN interface name")
@@ -94,8 +241,30 @@ func main() {
 	args.TunMask = flag.String("tunMask", "255.255.255.0", "TUN interface netmask, it should be a prefixlen (a number) for IPv6 address")
 	args.TunDns = flag.String("tunDns", "8.8.8.8,8.8.4.4", "DNS resolvers for TUN interface (only need on Windows)")
 	args.TunPersist = flag.Bool("tunPersist", false, "Persist TUN interface after the program exits or the last open file descriptor is closed (Linux only)")
+	args.TunQueues = flag.Int("tunQueues", 1, "Number of queues of the TUN interface, each queue is read by a separate goroutine and packets are written to the queue of their flow (Linux only)")
+	args.TunMtu = flag.Int("tunMtu", core.DefaultMTU, "MTU of the TUN interface and the TCP/IP stack, at least 1280")
+	args.TcpWindow = flag.Int("tcpWindow", core.DefaultTCPWindow, "TCP receive window size in bytes")
+	args.TcpSendBuffer = flag.Int("tcpSendBuffer", 0, "TCP send buffer size in bytes, 0 means the same as the receive window")
+	args.TcpMaxConns = flag.Int("tcpMaxConns", 0, "Maximum number of concurrent TCP connections, 0 means no limit")
+	args.TcpMaxConnsSrc = flag.Int("tcpMaxConnsPerSource", 0, "Maximum number of concurrent TCP connections of each source IP, 0 means no limit")
+	args.TcpMaxConnsDst = flag.Int("tcpMaxConnsPerDest", 0, "Maximum number of concurrent TCP connections to each destination IP, 0 means no limit")
+	args.UdpMaxSessions = flag.Int("udpMaxSessions", 0, "Maximum number of concurrent UDP sessions, the least recently active one is closed to make room for a new one, 0 means no limit")
+	args.UdpMaxSessionsSrc = flag.Int("udpMaxSessionsPerSource", 0, "Maximum number of concurrent UDP sessions of each source IP, 0 means no limit")
+	args.UdpMaxSessionsDst = flag.Int("udpMaxSessionsPerDest", 0, "Maximum number of concurrent UDP sessions to each destination IP, 0 means no limit")
+	args.TcpDeferHandshake = flag.Bool("tcpDeferHandshake", false, "Complete TCP handshakes with TUN clients only once the proxy connection is established")
+	args.UdpUnreachable = flag.Bool("udpUnreachable", false, "Reply with ICMP destination unreachable to UDP packets whose proxy session fails")
+	args.DialTimeout = flag.Duration("dialTimeout", 0, "Time given to the proxy handler to connect a new TCP connection or UDP session, 0 means no timeout")
+	args.ACL = flag.String("acl", "", "File of access control rules filtering connections and UDP packets through the tunnel")
+	args.RateLimit = flag.Int64("rateLimit", 0, "Bandwidth limit of all connections in bytes per second, 0 means no limit")
+	args.RateLimitSource = flag.Int64("rateLimitSource", 0, "Bandwidth limit of the connections of each source IP in bytes per second, 0 means no limit")
+	args.RateLimitDest = flag.Int64("rateLimitDest", 0, "Bandwidth limit of the connections to each destination IP in bytes per second, 0 means no limit")
+	args.RateLimitConn = flag.Int64("rateLimitConn", 0, "Bandwidth limit of each connection in bytes per second, 0 means no limit")
+	args.TunOffload = flag.Bool("tunOffload", false, "Enable TCP segmentation offloads on the TUN interface (Linux only)")
 	args.BlockOutsideDns = flag.Bool("blockOutsideDns", false, "Prevent DNS leaks by blocking plaintext DNS queries going out through non-TUN interface (may require admin privileges) (Windows only) ")
 	args.ProxyType = flag.String("proxyType", "socks", "Proxy handler type")
+	args.ShutdownTimeout = flag.Duration("shutdownTimeout", 5*time.Second, "Time given to connections to finish on exit")
+	args.Middlewares = flag.String("middlewares", "", "Comma-separated middlewares wrapping the proxy handler, the first one sees connections first (recover, log, metrics)")
+	args.MetricsInterval = flag.Duration("metricsInterval", time.Minute, "Interval of logging metrics collected by the metrics middleware, ACL and overload counters")
 	args.LogLevel = flag.String("loglevel", "info", "Logging level. (debug, info, warn, error, none)")
 
 	flag.Parse()
@@ -130,7 +299,17 @@ func main() {
 
 	// Open the tun device.
 	dnsServers := strings.Split(*args.TunDns, ",")
-	tunDev, err := tun.OpenTunDevice(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, *args.TunPersist)
+	var tunDevs []io.ReadWriteCloser
+	var err error
+	if *args.TunOffload {
+		tunDevs, err = tun.OpenOffloadTunDevice(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, *args.TunPersist, *args.TunMtu, *args.TunQueues)
+	} else if *args.TunQueues > 1 {
+		tunDevs, err = tun.OpenMultiQueueTunDevice(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, *args.TunPersist, *args.TunMtu, *args.TunQueues)
+	} else {
+		var tunDev io.ReadWriteCloser
+		tunDev, err = tun.OpenTunDevice(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, *args.TunPersist, *args.TunMtu)
+		tunDevs = []io.ReadWriteCloser{tunDev}
+	}
 	if err != nil {
 		log.Fatalf("failed to open tun device: %v", err)
 	}
@@ -141,8 +320,52 @@ func main() {
 		}
 	}
 
+	var accessList *acl.ACL
+	if *args.ACL != "" {
+		accessList, err = acl.Load(*args.ACL)
+		if err != nil {
+			log.Fatalf("failed to load ACL: %v", err)
+		}
+		if *args.MetricsInterval > 0 {
+			go func() {
+				for range time.Tick(*args.MetricsInterval) {
+					log.Infof("acl: %v", accessList)
+				}
+			}()
+		}
+	}
+
+	if *args.MetricsInterval > 0 && *args.TcpMaxConns+*args.TcpMaxConnsSrc+*args.TcpMaxConnsDst+*args.UdpMaxSessions+*args.UdpMaxSessionsSrc+*args.UdpMaxSessionsDst > 0 {
+		go func() {
+			for range time.Tick(*args.MetricsInterval) {
+				log.Infof("overload: %v", core.CurrentOverloadStats())
+			}
+		}()
+	}
+
 	// Setup TCP/IP stack.
-	lwipWriter := core.NewLWIPStack().(io.Writer)
+	lwipStack := core.NewLWIPStackWithOptions(&core.StackOptions{
+		MTU:                          *args.TunMtu,
+		TCPWindow:                    *args.TcpWindow,
+		TCPSendBuffer:                *args.TcpSendBuffer,
+		MaxTCPConns:                  *args.TcpMaxConns,
+		MaxTCPConnsPerSource:         *args.TcpMaxConnsSrc,
+		MaxTCPConnsPerDestination:    *args.TcpMaxConnsDst,
+		MaxUDPSessions:               *args.UdpMaxSessions,
+		MaxUDPSessionsPerSource:      *args.UdpMaxSessionsSrc,
+		MaxUDPSessionsPerDestination: *args.UdpMaxSessionsDst,
+		DeferTCPHandshake:            *args.TcpDeferHandshake,
+		UDPUnreachable:               *args.UdpUnreachable,
+		DialTimeout:                  *args.DialTimeout,
+		InterfaceName:                *args.TunName,
+		ACL:                          accessList,
+		RateLimits: core.RateLimits{
+			Global:         *args.RateLimit,
+			PerSource:      *args.RateLimitSource,
+			PerDestination: *args.RateLimitDest,
+			PerConn:        *args.RateLimitConn,
+		},
+	})
 
 	// Register TCP and UDP handlers to handle accepted connections.
 	if creater, found := handlerCreater[*args.ProxyType]; found {
@@ -160,23 +383,66 @@ func main() {
 		}
 	}
 
+	if *args.Middlewares != "" {
+		useMiddlewares(*args.Middlewares)
+	}
+
 	// Register an output callback to write packets output from lwip stack to tun
 	// device, output function should be set before input any packets.
-	core.RegisterOutputFn(func(data []byte) (int, error) {
-		return tunDev.Write(data)
-	})
-
-	// Copy packets from tun device to lwip stack, it's the main loop.
-	go func() {
-		_, err := io.CopyBuffer(lwipWriter, tunDev, make([]byte, MTU))
-		if err != nil {
-			log.Fatalf("copying data failed: %v", err)
+	// Packets are written to the queue of their flow when there are several.
+	pump := pumpPackets
+	if _, ok := tunDevs[0].(tun.VectorWriter); ok && *args.TunOffload {
+		vws := make([]tun.VectorWriter, len(tunDevs))
+		for i, dev := range tunDevs {
+			vws[i] = dev.(tun.VectorWriter)
 		}
-	}()
+		// Coalesce TCP segments output by the stack into super-segments.
+		core.RegisterOutputBatchFn(func(pkts [][]byte) (int, error) {
+			err := core.CoalesceTCP(pkts, func(bufs [][]byte) error {
+				// The IP header follows the virtio-net header.
+				_, err := vws[tun.FlowQueue(bufs[1], len(vws))].WriteBuffers(bufs)
+				return err
+			})
+			if err != nil {
+				return 0, err
+			}
+			return len(pkts), nil
+		})
+		pump = pumpOffloadPackets
+	} else {
+		var tunDev io.Writer = tunDevs[0]
+		if len(tunDevs) > 1 {
+			tunDev = tun.NewMultiQueueWriter(tunDevs)
+		}
+		if bw, ok := tunDev.(tun.BatchWriter); ok {
+			core.RegisterOutputBatchFn(bw.WriteBatch)
+		} else {
+			core.RegisterOutputFn(tunDev.Write)
+		}
+	}
+
+	// Copy packets from tun device to lwip stack, it's the main loop. Each
+	// queue has its own reader, the stack accepts concurrent writes.
+	for _, dev := range tunDevs {
+		go func(dev io.Reader) {
+			err := pump(dev, lwipStack, *args.TunMtu)
+			if err != nil {
+				log.Fatalf("copying data failed: %v", err)
+			}
+		}(dev)
+	}
 
 	log.Infof("Running tun2socks")
 
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
 	<-osSignals
+
+	// Let connections finish before exiting.
+	log.Infof("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *args.ShutdownTimeout)
+	defer cancel()
+	if err := lwipStack.CloseContext(ctx); err != nil {
+		log.Warnf("failed to close the stack gracefully: %v", err)
+	}
 }
@@ -4,26 +4,54 @@ package main
 
 import (
 	"net"
+	"strings"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/group"
 	"github.com/eycorsican/go-tun2socks/proxy/socks"
 )
 
 func init() {
 	args.addFlag(fProxyServer)
 	args.addFlag(fUdpTimeout)
+	args.addFlag(fProxyGroup)
 
 	registerHandlerCreater("socks", func() {
-		// Verify proxy server address.
-		proxyAddr, err := net.ResolveTCPAddr("tcp", *args.ProxyServer)
-		if err != nil {
-			log.Fatalf("invalid proxy server address: %v", err)
+		// Several comma-separated proxy servers make a group.
+		servers := strings.Split(*args.ProxyServer, ",")
+		if len(servers) == 1 {
+			proxyHost, proxyPort := parseProxyServer(servers[0])
+			core.RegisterTCPConnHandler(socks.NewTCPHandler(proxyHost, proxyPort))
+			core.RegisterUDPConnHandler(socks.NewUDPHandler(proxyHost, proxyPort, *args.UdpTimeout))
+			return
 		}
-		proxyHost := proxyAddr.IP.String()
-		proxyPort := uint16(proxyAddr.Port)
 
-		core.RegisterTCPConnHandler(socks.NewTCPHandler(proxyHost, proxyPort))
-		core.RegisterUDPConnHandler(socks.NewUDPHandler(proxyHost, proxyPort, *args.UdpTimeout))
+		strategy, err := group.ParseStrategy(*args.ProxyStrategy)
+		if err != nil {
+			log.Fatalf("invalid proxy strategy: %v", err)
+		}
+		var upstreams []group.Upstream
+		for _, server := range servers {
+			proxyHost, proxyPort := parseProxyServer(server)
+			upstreams = append(upstreams, group.Upstream{
+				Name:  server,
+				TCP:   socks.NewTCPHandler(proxyHost, proxyPort),
+				UDP:   socks.NewUDPHandler(proxyHost, proxyPort, *args.UdpTimeout),
+				Probe: socks.NewProbe(proxyHost, proxyPort, *args.ProbeTarget),
+			})
+		}
+		g := group.New(upstreams, group.Options{Strategy: strategy, ProbeInterval: *args.ProbeInterval})
+		core.RegisterTCPConnHandler(g)
+		core.RegisterUDPConnHandler(g)
 	})
 }
+
+// parseProxyServer verifies a proxy server address.
+func parseProxyServer(server string) (string, uint16) {
+	proxyAddr, err := net.ResolveTCPAddr("tcp", strings.TrimSpace(server))
+	if err != nil {
+		log.Fatalf("invalid proxy server address: %v", err)
+	}
+	return proxyAddr.IP.String(), uint16(proxyAddr.Port)
+}
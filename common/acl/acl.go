@@ -0,0 +1,335 @@
+// Package acl implements access control lists deciding which flows are
+// allowed through the tunnel.
+//
+// An ACL file has a rule per line, blank lines and text following a # are
+// ignored:
+//
+//	ACTION [PROTOCOL] [from ADDRS] [to ADDRS] [port PORTS]
+//	default ACTION
+//
+// ACTION is allow, deny or reject. Denied TCP connections are reset and
+// denied UDP datagrams dropped, rejected flows are answered with an ICMP
+// administratively prohibited message. PROTOCOL is tcp, udp or any. ADDRS
+// is a comma-separated list of IP addresses or CIDR prefixes matched
+// against the source or destination address, PORTS a comma-separated list
+// of destination ports or ranges such as 8000-8080. Omitted fields match
+// anything.
+//
+// Rules are evaluated in order and the first matching one applies, flows
+// matching none get the default action, allow unless set otherwise:
+//
+//	allow tcp to 10.1.0.0/16 port 443
+//	reject udp port 53
+//	deny from 192.168.1.100
+//	deny to 10.0.0.0/8,172.16.0.0/12
+//	default allow
+package acl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Action is what is done with a flow.
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+	Reject
+)
+
+var actionNames = [...]string{Allow: "allow", Deny: "deny", Reject: "reject"}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return fmt.Sprintf("action(%d)", int(a))
+	}
+	return actionNames[a]
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min, Max uint16
+}
+
+// Rule applies Action to flows matching all of its fields.
+type Rule struct {
+	Action Action
+
+	// Network is "tcp" or "udp", empty to match both.
+	Network string
+
+	// Sources and Destinations are the prefixes the source and destination
+	// addresses are matched against, nil to match any address.
+	Sources      []*net.IPNet
+	Destinations []*net.IPNet
+
+	// Ports are the destination ports matched, nil to match any port.
+	Ports []PortRange
+
+	hits int64
+}
+
+func (r *Rule) match(network string, src, dst net.IP, port int) bool {
+	if r.Network != "" && r.Network != network {
+		return false
+	}
+	if r.Sources != nil && !containsIP(r.Sources, src) {
+		return false
+	}
+	if r.Destinations != nil && !containsIP(r.Destinations, dst) {
+		return false
+	}
+	if r.Ports != nil {
+		for _, pr := range r.Ports {
+			if port >= int(pr.Min) && port <= int(pr.Max) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is a list of rules, it's safe for concurrent use. Rules must not be
+// modified once the ACL is in use.
+type ACL struct {
+	Rules []*Rule
+
+	// Default is the action for flows matching no rule.
+	Default Action
+
+	defaultHits int64
+	tcpDenied   int64
+	udpDenied   int64
+}
+
+// Stats are the counters of an ACL.
+type Stats struct {
+	// TCPDenied is the number of TCP connections denied or rejected.
+	TCPDenied int64
+
+	// UDPDenied is the number of UDP datagrams denied or rejected.
+	UDPDenied int64
+
+	// RuleHits is the number of flows each rule matched, in order.
+	RuleHits []int64
+
+	// DefaultHits is the number of flows no rule matched.
+	DefaultHits int64
+}
+
+// Check returns the action for a new flow of network, "tcp" or "udp", from
+// src to port of dst, and counts it.
+func (a *ACL) Check(network string, src, dst net.IP, port int) Action {
+	action := a.Default
+	hits := &a.defaultHits
+	for _, r := range a.Rules {
+		if r.match(network, src, dst, port) {
+			action = r.Action
+			hits = &r.hits
+			break
+		}
+	}
+	atomic.AddInt64(hits, 1)
+	if action != Allow {
+		if network == "tcp" {
+			atomic.AddInt64(&a.tcpDenied, 1)
+		} else {
+			atomic.AddInt64(&a.udpDenied, 1)
+		}
+	}
+	return action
+}
+
+// Stats returns a snapshot of the counters of a.
+func (a *ACL) Stats() Stats {
+	s := Stats{
+		TCPDenied:   atomic.LoadInt64(&a.tcpDenied),
+		UDPDenied:   atomic.LoadInt64(&a.udpDenied),
+		RuleHits:    make([]int64, len(a.Rules)),
+		DefaultHits: atomic.LoadInt64(&a.defaultHits),
+	}
+	for i, r := range a.Rules {
+		s.RuleHits[i] = atomic.LoadInt64(&r.hits)
+	}
+	return s
+}
+
+// String returns the counters of a in JSON, so that it implements
+// expvar.Var.
+func (a *ACL) String() string {
+	b, _ := json.Marshal(a.Stats())
+	return string(b)
+}
+
+// Load reads an ACL from the file at path.
+func Load(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	acl, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return acl, nil
+}
+
+// Parse reads an ACL from r.
+func Parse(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "default" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: invalid default action", n)
+			}
+			action, err := parseAction(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			acl.Default = action
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseAction(s string) (Action, error) {
+	for a, name := range actionNames {
+		if s == name {
+			return Action(a), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q", s)
+}
+
+func parseRule(fields []string) (*Rule, error) {
+	action, err := parseAction(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rule := &Rule{Action: action}
+	fields = fields[1:]
+	if len(fields) > 0 {
+		switch fields[0] {
+		case "tcp", "udp":
+			rule.Network = fields[0]
+			fields = fields[1:]
+		case "any":
+			fields = fields[1:]
+		}
+	}
+	for len(fields) > 0 {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("missing value of %q", fields[0])
+		}
+		key, value := fields[0], fields[1]
+		fields = fields[2:]
+		switch key {
+		case "from":
+			if rule.Sources, err = parseNets(value); err != nil {
+				return nil, err
+			}
+		case "to":
+			if rule.Destinations, err = parseNets(value); err != nil {
+				return nil, err
+			}
+		case "port":
+			if rule.Ports, err = parsePorts(value); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", key)
+		}
+	}
+	return rule, nil
+}
+
+// parseNets parses comma-separated addresses or prefixes, it returns nil
+// for any.
+func parseNets(s string) ([]*net.IPNet, error) {
+	if s == "any" {
+		return nil, nil
+	}
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parsePorts parses comma-separated ports or ranges, it returns nil for any.
+func parsePorts(s string) ([]PortRange, error) {
+	if s == "any" {
+		return nil, nil
+	}
+	var ports []PortRange
+	for _, v := range strings.Split(s, ",") {
+		lo, hi := v, v
+		if i := strings.IndexByte(v, '-'); i >= 0 {
+			lo, hi = v[:i], v[i+1:]
+		}
+		min, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", v)
+		}
+		max, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || max < min {
+			return nil, fmt.Errorf("invalid port %q", v)
+		}
+		ports = append(ports, PortRange{Min: uint16(min), Max: uint16(max)})
+	}
+	return ports, nil
+}
@@ -0,0 +1,64 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/include
+#include "lwip/tcp.h"
+#include "lwip/priv/tcp_priv.h"
+*/
+import "C"
+import (
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/common/acl"
+)
+
+// accessList filters new TCP connections and UDP datagrams before handlers
+// see them, nil if all are allowed. It's only accessed by the loop
+// goroutine.
+var accessList *acl.ACL
+
+// tcpACLRefused applies the ACL to a new connection before the SYN-ACK is
+// sent, it reports whether the connection was refused, pcb is then freed.
+func tcpACLRefused(pcb *C.struct_tcp_pcb) bool {
+	if accessList == nil {
+		return false
+	}
+	src := ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port))
+	dst := ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port))
+	switch accessList.Check("tcp", src.IP, dst.IP, dst.Port) {
+	case acl.Allow:
+		return false
+	case acl.Reject:
+		// Freed without a RST, the client is told by an ICMP message
+		// quoting its SYN.
+		iss := uint32(pcb.rcv_nxt) - 1
+		C.tcp_abandon(pcb, 0)
+		outputProhibited(buildTCPSYN(src, dst, iss))
+	default:
+		C.tcp_abort(pcb)
+	}
+	return true
+}
+
+// udpACLRefused applies the ACL to a datagram from src to dst, it reports
+// whether the datagram must be dropped.
+func udpACLRefused(src, dst *net.UDPAddr, data []byte) bool {
+	if accessList == nil {
+		return false
+	}
+	switch accessList.Check("udp", src.IP, dst.IP, dst.Port) {
+	case acl.Allow:
+		return false
+	case acl.Reject:
+		outputProhibited(buildUDP(src, dst, data))
+	}
+	return true
+}
+
+// outputProhibited tells the client the packet orig is administratively
+// prohibited.
+func outputProhibited(orig []byte) {
+	if pkt, err := buildICMPUnreachable(unreachProhibited, orig); err == nil {
+		outputPacket(pkt)
+	}
+}
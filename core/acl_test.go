@@ -0,0 +1,164 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/common/acl"
+)
+
+func parseACL(t *testing.T, s string) *acl.ACL {
+	a, err := acl.Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestACLParse(t *testing.T) {
+	a := parseACL(t, `
+# Corporate egress policy.
+allow tcp to 10.1.0.0/16 port 443,8000-8080
+reject udp port 53   # DNS goes through the tunnel resolver.
+deny from 192.168.1.100 to any
+deny any to 10.0.0.0/8,2001:db8::/32
+default deny
+`)
+	for _, tc := range []struct {
+		network string
+		src     string
+		dst     string
+		port    int
+		action  acl.Action
+	}{
+		{"tcp", "192.168.1.1", "10.1.2.3", 443, acl.Allow},
+		{"tcp", "192.168.1.1", "10.1.2.3", 8080, acl.Allow},
+		{"tcp", "192.168.1.1", "10.1.2.3", 22, acl.Deny},
+		{"udp", "192.168.1.1", "10.1.2.3", 443, acl.Deny},
+		{"udp", "192.168.1.1", "8.8.8.8", 53, acl.Reject},
+		{"tcp", "192.168.1.1", "8.8.8.8", 53, acl.Deny},
+		{"tcp", "192.168.1.100", "10.1.2.3", 443, acl.Allow},
+		{"tcp", "2001:db8::1", "2001:db8::2", 443, acl.Deny},
+	} {
+		if action := a.Check(tc.network, net.ParseIP(tc.src), net.ParseIP(tc.dst), tc.port); action != tc.action {
+			t.Errorf("%s %s -> %s:%d: got %v, want %v", tc.network, tc.src, tc.dst, tc.port, action, tc.action)
+		}
+	}
+	stats := a.Stats()
+	if stats.TCPDenied != 3 || stats.UDPDenied != 2 || stats.DefaultHits != 1 {
+		t.Errorf("wrong counters %v", a)
+	}
+	if hits := stats.RuleHits; len(hits) != 4 || hits[0] != 3 || hits[1] != 1 || hits[2] != 0 || hits[3] != 3 {
+		t.Errorf("wrong rule hits %v", hits)
+	}
+
+	for _, s := range []string{
+		"drop tcp",
+		"allow tcp to",
+		"allow tcp to 10.0.0.300",
+		"allow tcp port 80-22",
+		"allow tcp port 65536",
+		"allow tcp via eth0",
+		"default",
+	} {
+		if _, err := acl.Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("parsed invalid ACL %q", s)
+		}
+	}
+}
+
+// A connection denied by the ACL is reset before it's established.
+func TestTCPACLDeny(t *testing.T) {
+	h := &fakeTCPHandler{}
+	a := parseACL(t, "deny tcp to 10.0.0.2 port 80")
+	s, p := setupTCPWithOptions(t, h, &StackOptions{ACL: a})
+	defer s.Close()
+
+	write(s, buildTCPv4Ack(p.seq, 0, tcpSYN, nil), t)
+	p.waitRST()
+	if p.established {
+		t.Error("SYN-ACK sent for a denied connection")
+	}
+	if n := atomic.LoadInt32(&tcpConnCount); n != 0 {
+		t.Fatalf("%d connections left", n)
+	}
+	if a.Stats().TCPDenied != 1 {
+		t.Errorf("wrong counters %v", a)
+	}
+}
+
+// The client is told a rejected connection is prohibited.
+func TestTCPACLReject(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCPWithOptions(t, h, &StackOptions{ACL: parseACL(t, "reject from 10.0.0.0/24")})
+	defer s.Close()
+
+	write(s, buildTCPv4Ack(p.seq, 0, tcpSYN, nil), t)
+	p.Lock()
+	for p.icmp == nil {
+		p.cond.Wait()
+	}
+	p.Unlock()
+	if p.established || p.rst {
+		t.Error("unexpected TCP segment")
+	}
+
+	icmph := p.icmp[ipv4HeaderLen:]
+	if checksum(icmph) != 0 || icmph[0] != icmpv4DestUnreach || icmph[1] != 13 {
+		t.Errorf("got ICMP type %d code %d, want administratively prohibited", icmph[0], icmph[1])
+	}
+	tcph := icmph[icmpHeaderLen+ipv4HeaderLen:]
+	if binary.BigEndian.Uint16(tcph[2:4]) != 80 || binary.BigEndian.Uint32(tcph[4:8]) != p.seq {
+		t.Error("wrong quoted SYN")
+	}
+}
+
+// Allowed connections are handled as usual, with or without deferred
+// handshakes.
+func TestTCPACLAllow(t *testing.T) {
+	for _, deferred := range []bool{false, true} {
+		h := &fakeTCPHandler{}
+		opts := &StackOptions{ACL: parseACL(t, "allow tcp port 80\ndefault deny"), DeferTCPHandshake: deferred}
+		s, p := setupTCPWithOptions(t, h, opts)
+		p.connect()
+		conn := <-h.conns
+		data := []byte("hello")
+		write(s, p.segment(data), t)
+		assertEqual(<-readN(conn, len(data)), data, t)
+		s.Close()
+	}
+}
+
+// Datagrams are checked one by one, denied ones are dropped and rejected
+// ones answered with ICMP.
+func TestUDPACL(t *testing.T) {
+	s, h := setupUDP(t)
+	s.Close()
+	a := parseACL(t, "deny udp to 216.239.35.4 port 123\nreject udp to 2001:db8::2")
+	s = NewLWIPStackWithOptions(&StackOptions{ACL: a})
+	defer s.Close()
+	output := make(chan []byte, 1)
+	RegisterOutputFn(func(pkt []byte) (int, error) {
+		output <- append([]byte(nil), pkt...)
+		return len(pkt), nil
+	})
+
+	write(s, ntp, t)
+	write(s, udp6, t)
+	icmp := <-output
+	icmph := icmp[ipv6Header:]
+	if icmp[6] != proto_icmpv6 || icmph[0] != icmpv6DestUnreach || icmph[1] != 1 {
+		t.Errorf("got ICMPv6 type %d code %d, want administratively prohibited", icmph[0], icmph[1])
+	}
+	select {
+	case data := <-h.packets:
+		t.Errorf("denied datagram received: %x", data)
+	default:
+	}
+	if n := a.Stats().UDPDenied; n != 2 {
+		t.Errorf("%d datagrams denied", n)
+	}
+}
@@ -14,7 +14,7 @@ import (
 )
 
 // ipaddr_ntoa() is using a global static buffer to return result,
-// reentrants are not allowed, caller is required to lock lwipMutex.
+// reentrants are not allowed, it must be called on the loop goroutine.
 func ipAddrNTOA(ipaddr C.struct_ip_addr) string {
 	return C.GoString(C.ipaddr_ntoa(&ipaddr))
 }
@@ -133,6 +133,8 @@ PACK_STRUCT_END
 #error "MEMP_NUM_REASSDATA > IP_REASS_MAX_PBUFS doesn't make sense since each struct ip_reassdata must hold 2 pbufs at least!"
 #endif
 #endif /* !MEMP_MEM_MALLOC */
+#if !TUN2SOCKS
+/* go-tun2socks sets these values at runtime and checks them in Go */
 #if LWIP_WND_SCALE
 #if (LWIP_TCP && (TCP_WND > 0xffffffff))
 #error "If you want to use TCP, TCP_WND must fit in an u32_t, so, you have to reduce it in your lwipopts.h"
@@ -157,6 +159,7 @@ PACK_STRUCT_END
 #if (LWIP_TCP && (TCP_SND_QUEUELEN < 2))
 #error "TCP_SND_QUEUELEN must be at least 2 for no-copy TCP writes to work"
 #endif
+#endif /* !TUN2SOCKS */
 #if (LWIP_TCP && ((TCP_MAXRTX > 12) || (TCP_SYNMAXRTX > 12)))
 #error "If you want to use TCP, TCP_MAXRTX and TCP_SYNMAXRTX must less or equal to 12 (due to tcp_backoff table), so, you have to reduce them in your lwipopts.h"
 #endif
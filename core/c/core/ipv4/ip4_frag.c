@@ -118,6 +118,39 @@ static u16_t ip_reass_pbufcount;
 static void ip_reass_dequeue_datagram(struct ip_reassdata *ipr, struct ip_reassdata *prev);
 static int ip_reass_free_complete_datagram(struct ip_reassdata *ipr, struct ip_reassdata *prev);
 
+#if TUN2SOCKS
+/**
+ * Returns whether datagrams are being reassembled, i.e. whether
+ * ip_reass_tmr() has anything to do.
+ */
+int
+ip_reass_pending(void)
+{
+  return reassdatagrams != NULL;
+}
+
+/**
+ * Frees all datagrams being reassembled without sending ICMP time exceeded
+ * packets, used when the stack is closed.
+ */
+void
+ip_reass_free_all(void)
+{
+  struct pbuf *p, *pcur;
+
+  while (reassdatagrams != NULL) {
+    p = reassdatagrams->p;
+    while (p != NULL) {
+      pcur = p;
+      p = ((struct ip_reass_helper *)p->payload)->next_pbuf;
+      pbuf_free(pcur);
+    }
+    ip_reass_dequeue_datagram(reassdatagrams, NULL);
+  }
+  ip_reass_pbufcount = 0;
+}
+#endif /* TUN2SOCKS */
+
 /**
  * Reassembly timer base function
  * for both NO_SYS == 0 and 1 (!).
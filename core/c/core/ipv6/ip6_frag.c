@@ -109,6 +109,42 @@ static void ip6_reass_free_complete_datagram(struct ip6_reassdata *ipr);
 static void ip6_reass_remove_oldest_datagram(struct ip6_reassdata *ipr, int pbufs_needed);
 #endif /* IP_REASS_FREE_OLDEST */
 
+#if TUN2SOCKS
+/**
+ * Returns whether datagrams are being reassembled, i.e. whether
+ * ip6_reass_tmr() has anything to do.
+ */
+int
+ip6_reass_pending(void)
+{
+  return reassdatagrams != NULL;
+}
+
+/**
+ * Frees all datagrams being reassembled without sending ICMP time exceeded
+ * packets, used when the stack is closed.
+ */
+void
+ip6_reass_free_all(void)
+{
+  struct ip6_reassdata *ipr;
+  struct pbuf *p, *pcur;
+
+  while (reassdatagrams != NULL) {
+    ipr = reassdatagrams;
+    p = ipr->p;
+    while (p != NULL) {
+      pcur = p;
+      p = ((struct ip6_reass_helper *)p->payload)->next_pbuf;
+      pbuf_free(pcur);
+    }
+    reassdatagrams = ipr->next;
+    memp_free(MEMP_IP6_REASSDATA, ipr);
+  }
+  ip6_reass_pbufcount = 0;
+}
+#endif /* TUN2SOCKS */
+
 void
 ip6_reass_tmr(void)
 {
@@ -731,6 +731,13 @@ tcp_listen_input(struct tcp_pcb_listen *pcb)
     }
 #endif
 
+#if TUN2SOCKS
+    if (tun2socks_tcp_syn != NULL && tun2socks_tcp_syn(npcb)) {
+      /* The SYN|ACK is withheld, or npcb was aborted. */
+      return;
+    }
+#endif /* TUN2SOCKS */
+
     /* Send a SYN|ACK together with the MSS option. */
     rc = tcp_enqueue_flags(npcb, TCP_SYN | TCP_ACK);
     if (rc != ERR_OK) {
@@ -742,6 +749,32 @@ tcp_listen_input(struct tcp_pcb_listen *pcb)
   return;
 }
 
+#if TUN2SOCKS
+/** Hook called for each new pcb, NULL if SYN|ACK segments are never
+ * withheld. */
+tcp_syn_fn tun2socks_tcp_syn;
+
+/**
+ * Sends the SYN|ACK withheld by tun2socks_tcp_syn.
+ *
+ * @param pcb the tcp_pcb in SYN_RCVD state
+ * @return ERR_OK if the SYN|ACK was enqueued, the pcb should be aborted
+ *         otherwise
+ */
+err_t
+tcp_syn_ack(struct tcp_pcb *pcb)
+{
+  err_t rc;
+
+  LWIP_ASSERT("tcp_syn_ack: pcb->state == SYN_RCVD", pcb->state == SYN_RCVD);
+  rc = tcp_enqueue_flags(pcb, TCP_SYN | TCP_ACK);
+  if (rc == ERR_OK) {
+    tcp_output(pcb);
+  }
+  return rc;
+}
+#endif /* TUN2SOCKS */
+
 /**
  * Called by tcp_input() when a segment arrives for a connection in
  * TIME_WAIT.
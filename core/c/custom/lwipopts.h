@@ -81,9 +81,28 @@
 #define LWIP_TCP_TIMESTAMPS 1
 */
 
-#define TCP_MSS 1460
-#define TCP_WND 32 * 1024
-#define TCP_SND_BUF (TCP_WND)
+// The MSS of connections is bounded by the MTU of the netif which is set
+// at runtime, TCP_MSS only caps it, allowing jumbo frames.
+#define TCP_MSS (9000 - 40)
+
+// The receive window, its scale factor and the send buffer are set at
+// runtime when creating the stack, see StackOptions in core/options.go.
+#include <stdint.h>
+extern uint32_t tun2socks_tcp_wnd;
+extern uint8_t tun2socks_tcp_rcv_scale;
+extern uint32_t tun2socks_tcp_snd_buf;
+#define LWIP_WND_SCALE 1
+#define TCP_RCV_SCALE (tun2socks_tcp_rcv_scale)
+#define TCP_WND (tun2socks_tcp_wnd)
+#define TCP_SND_BUF (tun2socks_tcp_snd_buf)
+// Checks on these values can't be done by the preprocessor.
+#define LWIP_DISABLE_TCP_SANITY_CHECKS 1
+// Sized for the minimum MSS rather than TCP_MSS, otherwise small segments
+// would exhaust the queue before the send buffer is full.
+#define TCP_SND_QUEUELEN ((4 * (TCP_SND_BUF) + (536 - 1)) / 536)
+// Keep pool pbufs the size of a common 1500 bytes packet, larger packets
+// are held in pbuf chains.
+#define PBUF_POOL_BUFSIZE 1500
 
 #define MEM_LIBC_MALLOC 1
 #define MEMP_MEM_MALLOC 1
@@ -420,6 +420,15 @@ void             tcp_accept  (struct tcp_pcb *pcb, tcp_accept_fn accept);
 #endif /* LWIP_CALLBACK_API */
 void             tcp_poll    (struct tcp_pcb *pcb, tcp_poll_fn poll, u8_t interval);
 
+#if TUN2SOCKS
+/** Function prototype for the hook called when a SYN creates a new pcb in
+ * SYN_RCVD state. Returning non-zero withholds the SYN|ACK, which is then
+ * sent by tcp_syn_ack(), or means the hook aborted the pcb. */
+typedef int (*tcp_syn_fn)(struct tcp_pcb *newpcb);
+extern tcp_syn_fn tun2socks_tcp_syn;
+err_t            tcp_syn_ack (struct tcp_pcb *pcb);
+#endif /* TUN2SOCKS */
+
 #define          tcp_set_flags(pcb, set_flags)     do { (pcb)->flags = (tcpflags_t)((pcb)->flags |  (set_flags)); } while(0)
 #define          tcp_clear_flags(pcb, clr_flags)   do { (pcb)->flags = (tcpflags_t)((pcb)->flags & (tcpflags_t)(~(clr_flags) & TCP_ALLFLAGS)); } while(0)
 #define          tcp_is_flag_set(pcb, flag)        (((pcb)->flags & (flag)) != 0)
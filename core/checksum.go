@@ -0,0 +1,70 @@
+package core
+
+import (
+	"encoding/binary"
+)
+
+// checksumAdd adds the one's complement sum of b, taken as a sequence of
+// 16-bit big endian words, to sum. The result is not folded.
+func checksumAdd(sum uint64, b []byte) uint64 {
+	for len(b) >= 8 {
+		sum += uint64(binary.BigEndian.Uint16(b[0:2]))
+		sum += uint64(binary.BigEndian.Uint16(b[2:4]))
+		sum += uint64(binary.BigEndian.Uint16(b[4:6]))
+		sum += uint64(binary.BigEndian.Uint16(b[6:8]))
+		b = b[8:]
+	}
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds sum to 16 bits.
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// checksum returns the Internet checksum of b.
+func checksum(b []byte) uint16 {
+	return ^checksumFold(checksumAdd(0, b))
+}
+
+// pseudoHeaderChecksum returns the unfolded sum of the IPv4 or IPv6 pseudo
+// header of a transport protocol segment.
+func pseudoHeaderChecksum(protocol proto, src, dst []byte, length int) uint64 {
+	sum := checksumAdd(0, src)
+	sum = checksumAdd(sum, dst)
+	sum += uint64(protocol)
+	sum += uint64(length)
+	return sum
+}
+
+// ipAddrs returns the source and destination addresses of an IP packet, the
+// header must have been validated.
+func ipAddrs(ipv ipver, p []byte) (src, dst []byte) {
+	if ipv == ipv4 {
+		return p[12:16], p[16:20]
+	}
+	return p[8:24], p[24:40]
+}
+
+// setIPLength sets the length fields of an IP packet of total length n, and
+// updates the IPv4 header checksum.
+func setIPLength(ipv ipver, p []byte, n int) {
+	if ipv == ipv4 {
+		iphLen := int(p[0]&0x0f) * 4
+		binary.BigEndian.PutUint16(p[2:4], uint16(n))
+		p[10], p[11] = 0, 0
+		binary.BigEndian.PutUint16(p[10:12], checksum(p[:iphLen]))
+	} else {
+		binary.BigEndian.PutUint16(p[4:6], uint16(n-ipv6HeaderLen))
+	}
+}
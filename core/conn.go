@@ -7,9 +7,8 @@ import (
 
 // TCPConn abstracts a TCP connection comming from TUN. This connection
 // should be handled by a registered TCP proxy handler. It's important
-// to note that callback members are called from lwIP, they are already
-// in the lwIP thread when they are called, that is, they are holding
-// the lwipMutex.
+// to note that callback members are called from lwIP, they run on the
+// goroutine owning lwIP and must not block.
 type TCPConn interface {
 	// Sent will be called when sent data has been acknowledged by peer.
 	Sent(len uint16) error
@@ -34,10 +33,15 @@ type TCPConn interface {
 	// LocalAddr returns the local client network address.
 	LocalAddr() net.Addr
 
-	// Read reads data comming from TUN, note that it reads from an
-	// underlying pipe that the writer writes in the lwip thread,
-	// write op blocks until previous written data is consumed, one
-	// should read out all data as soon as possible.
+	// Metadata returns the metadata of the connection.
+	Metadata() *ConnMetadata
+
+	// Read reads data comming from TUN, received data is queued up to
+	// the TCP receive window, the window is only reopened as data is
+	// read. Implementations also implement io.WriterTo to pass received
+	// data without copying it. Once the local peer has reset the
+	// connection, queued data is still returned, then an error wrapping
+	// syscall.ECONNRESET, like net.TCPConn.
 	Read(data []byte) (int, error)
 
 	// Write writes data to TUN.
@@ -69,6 +73,9 @@ type UDPConn interface {
 	// LocalAddr returns the local client network address.
 	LocalAddr() *net.UDPAddr
 
+	// Metadata returns the metadata of the session.
+	Metadata() *ConnMetadata
+
 	// ReceiveTo will be called when data arrives from TUN, and the received
 	// data should be sent to addr.
 	ReceiveTo(data []byte, addr *net.UDPAddr) error
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// connCaps are limits on concurrent connections, zero means no limit.
+type connCaps struct {
+	total     int
+	perSource int
+	perDest   int
+}
+
+func (c connCaps) set() bool {
+	return c.total > 0 || c.perSource > 0 || c.perDest > 0
+}
+
+// The limits on concurrent TCP connections and UDP sessions, only accessed
+// by the loop goroutine.
+var tcpCaps, udpCaps connCaps
+
+// ipPair is the source and destination IP of a connection.
+type ipPair struct {
+	src, dst ipKey
+}
+
+func newIPPair(src, dst net.IP) ipPair {
+	return ipPair{src: keyOf(src), dst: keyOf(dst)}
+}
+
+// ipCounts counts connections per source and destination IP.
+type ipCounts struct {
+	mu      sync.Mutex
+	sources map[ipKey]int
+	dests   map[ipKey]int
+}
+
+func newIPCounts() *ipCounts {
+	return &ipCounts{sources: make(map[ipKey]int), dests: make(map[ipKey]int)}
+}
+
+func (c *ipCounts) get(ips ipPair) (src, dst int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sources[ips.src], c.dests[ips.dst]
+}
+
+func (c *ipCounts) add(ips ipPair) {
+	c.mu.Lock()
+	c.sources[ips.src]++
+	c.dests[ips.dst]++
+	c.mu.Unlock()
+}
+
+func (c *ipCounts) remove(ips ipPair) {
+	c.mu.Lock()
+	if c.sources[ips.src]--; c.sources[ips.src] <= 0 {
+		delete(c.sources, ips.src)
+	}
+	if c.dests[ips.dst]--; c.dests[ips.dst] <= 0 {
+		delete(c.dests, ips.dst)
+	}
+	c.mu.Unlock()
+}
+
+var (
+	tcpIPCounts = newIPCounts()
+	udpIPCounts = newIPCounts()
+
+	// Number of sessions in udpConns.
+	udpConnCount int32
+)
+
+// overTCPCaps reports whether a new connection from src to dst would
+// exceed the limits.
+func overTCPCaps(ips ipPair) bool {
+	if tcpCaps.total > 0 && int(atomic.LoadInt32(&tcpConnCount)) >= tcpCaps.total {
+		return true
+	}
+	if tcpCaps.perSource > 0 || tcpCaps.perDest > 0 {
+		src, dst := tcpIPCounts.get(ips)
+		if tcpCaps.perSource > 0 && src >= tcpCaps.perSource {
+			return true
+		}
+		if tcpCaps.perDest > 0 && dst >= tcpCaps.perDest {
+			return true
+		}
+	}
+	return false
+}
+
+// makeUDPRoom closes the least recently active sessions in the way of a
+// new session from src to dst, it runs on the loop goroutine.
+func makeUDPRoom(ips ipPair) {
+	if !udpCaps.set() {
+		return
+	}
+	src, dst := udpIPCounts.get(ips)
+	if udpCaps.perSource > 0 && src >= udpCaps.perSource {
+		evictUDPConn(func(c *udpConn) bool { return c.ips.src == ips.src })
+	}
+	if udpCaps.perDest > 0 && dst >= udpCaps.perDest {
+		evictUDPConn(func(c *udpConn) bool { return c.ips.dst == ips.dst })
+	}
+	if udpCaps.total > 0 && int(atomic.LoadInt32(&udpConnCount)) >= udpCaps.total {
+		evictUDPConn(func(c *udpConn) bool { return true })
+	}
+}
+
+// evictUDPConn closes the least recently active session matching match, and
+// tells its handler.
+func evictUDPConn(match func(*udpConn) bool) {
+	var oldest *udpConn
+	udpConns.Range(func(_, c interface{}) bool {
+		conn := c.(*udpConn)
+		if match(conn) && (oldest == nil || conn.lastActive() < oldest.lastActive()) {
+			oldest = conn
+		}
+		return true
+	})
+	if oldest == nil {
+		return
+	}
+	oldest.Close()
+	atomic.AddInt64(&overloadStats.UDPEvicted, 1)
+	if h, ok := unwrapHandler(oldest.handler).(UDPConnCloseHandler); ok {
+		go h.CloseConn(oldest)
+	}
+}
+
+// OverloadStats counts connections affected by the limits on concurrent
+// connections.
+type OverloadStats struct {
+	// TCPRefused is the number of new TCP connections reset.
+	TCPRefused int64
+
+	// UDPEvicted is the number of UDP sessions closed to make room for
+	// new ones.
+	UDPEvicted int64
+}
+
+var overloadStats OverloadStats
+
+// CurrentOverloadStats returns a snapshot of the counters.
+func CurrentOverloadStats() OverloadStats {
+	return OverloadStats{
+		TCPRefused: atomic.LoadInt64(&overloadStats.TCPRefused),
+		UDPEvicted: atomic.LoadInt64(&overloadStats.UDPEvicted),
+	}
+}
+
+// String returns the counters in JSON.
+func (s OverloadStats) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// New connections over the limits are reset.
+func TestTCPConnLimits(t *testing.T) {
+	for _, opts := range []*StackOptions{
+		{MaxTCPConns: 1},
+		{MaxTCPConnsPerSource: 1},
+		{MaxTCPConnsPerDestination: 1, DeferTCPHandshake: true},
+	} {
+		h := &fakeTCPHandler{}
+		s, p := setupTCPWithOptions(t, h, opts)
+		p.connect()
+		<-h.conns
+		refused := CurrentOverloadStats().TCPRefused
+
+		// Another connection from port 1001.
+		syn := buildTCPv4Ack(2000, 0, tcpSYN, nil)
+		binary.BigEndian.PutUint16(syn[ipv4HeaderLen:], 1001)
+		binary.BigEndian.PutUint16(syn[ipv4HeaderLen+16:], 0)
+		sum := pseudoHeaderChecksum(proto_tcp, syn[12:16], syn[16:20], tcpHeaderLen)
+		binary.BigEndian.PutUint16(syn[ipv4HeaderLen+16:], ^checksumFold(checksumAdd(sum, syn[ipv4HeaderLen:])))
+		write(s, syn, t)
+		p.waitRST()
+		if n := CurrentOverloadStats().TCPRefused - refused; n != 1 {
+			t.Errorf("%+v: %d connections refused", opts, n)
+		}
+		s.Close()
+	}
+}
+
+// evictUDPHandler passes sessions closed by the stack to closed.
+type evictUDPHandler struct {
+	discardUDPHandler
+	closed chan UDPConn
+}
+
+func (h evictUDPHandler) CloseConn(conn UDPConn) {
+	h.closed <- conn
+}
+
+// ntpFrom returns the ntp datagram sent from port.
+func ntpFrom(port uint16) []byte {
+	pkt := decode(ntpHex)
+	binary.BigEndian.PutUint16(pkt[ipv4Header:], port)
+	return pkt
+}
+
+// The least recently active session is closed to make room for a new one.
+func TestUDPSessionLimits(t *testing.T) {
+	for _, opts := range []*StackOptions{
+		{MaxUDPSessions: 2},
+		{MaxUDPSessionsPerSource: 2},
+		{MaxUDPSessionsPerDestination: 2},
+	} {
+		s, _ := setupUDP(t)
+		s.Close()
+		s = NewLWIPStackWithOptions(opts)
+		h := evictUDPHandler{closed: make(chan UDPConn, 1)}
+		RegisterUDPConnHandler(h)
+		evicted := CurrentOverloadStats().UDPEvicted
+
+		write(s, ntpFrom(1), t)
+		time.Sleep(time.Millisecond)
+		write(s, ntpFrom(2), t)
+		time.Sleep(time.Millisecond)
+		write(s, ntpFrom(1), t)
+		time.Sleep(time.Millisecond)
+		write(s, ntpFrom(3), t)
+
+		conn := <-h.closed
+		if port := conn.LocalAddr().Port; port != 2 {
+			t.Errorf("%+v: session from port %d evicted", opts, port)
+		}
+		for _, port := range []int{1, 3} {
+			src := &net.UDPAddr{IP: net.IPv4(100, 106, 65, 0), Port: port}
+			if _, ok := udpConns.Load(udpConnId{src: src.String()}); !ok {
+				t.Errorf("%+v: session from port %d closed", opts, port)
+			}
+		}
+		if n := CurrentOverloadStats().UDPEvicted - evicted; n != 1 {
+			t.Errorf("%+v: %d sessions evicted", opts, n)
+		}
+		s.Close()
+	}
+}
+
+// slowUDPHandler connects sessions from port 1 once release is closed, and
+// passes sessions closed by the stack to closed.
+type slowUDPHandler struct {
+	discardUDPHandler
+	release chan struct{}
+	closed  chan UDPConn
+}
+
+func (h slowUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	if conn.LocalAddr().Port == 1 {
+		<-h.release
+	}
+	return nil
+}
+
+func (h slowUDPHandler) CloseConn(conn UDPConn) {
+	h.closed <- conn
+}
+
+// A session evicted while connecting stays closed once connected, and its
+// counts are released once.
+func TestUDPEvictConnecting(t *testing.T) {
+	s, _ := setupUDP(t)
+	s.Close()
+	s = NewLWIPStackWithOptions(&StackOptions{MaxUDPSessions: 1})
+	defer s.Close()
+	h := slowUDPHandler{release: make(chan struct{}), closed: make(chan UDPConn, 4)}
+	RegisterUDPConnHandler(h)
+
+	write(s, ntpFrom(1), t)
+	write(s, ntpFrom(2), t)
+	evicted := <-h.closed
+	if port := evicted.LocalAddr().Port; port != 1 {
+		t.Fatalf("session from port %d evicted", port)
+	}
+	close(h.release)
+	// The handler is told again once connected.
+	select {
+	case conn := <-h.closed:
+		if conn != evicted {
+			t.Fatalf("session from port %d closed", conn.LocalAddr().Port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler not told the session is closed")
+	}
+
+	if err := evicted.(*udpConn).checkState(); err == nil {
+		t.Error("evicted session connected")
+	}
+	if n := atomic.LoadInt32(&udpConnCount); n != 1 {
+		t.Errorf("%d sessions counted, want 1", n)
+	}
+	evicted.Close()
+	if n := atomic.LoadInt32(&udpConnCount); n != 1 {
+		t.Errorf("%d sessions counted after closing the evicted session again, want 1", n)
+	}
+	if src, dst := udpIPCounts.get(evicted.(*udpConn).ips); src != 1 || dst != 1 {
+		t.Errorf("%d sessions counted from the source, %d to the destination, want 1", src, dst)
+	}
+	src := &net.UDPAddr{IP: net.IPv4(100, 106, 65, 0), Port: 2}
+	if _, ok := udpConns.Load(udpConnId{src: src.String()}); !ok {
+		t.Error("session from port 2 closed")
+	}
+}
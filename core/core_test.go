@@ -2,23 +2,33 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"net"
-	"sync"
+	"syscall"
 	"testing"
 )
 
 const (
 	ipv4Header = 20 // Length of the IPv4 header in bytes.
+	ipv6Header = 40 // Length of the IPv6 header in bytes.
+	ipv6Ext    = 8  // Length of the IPv6 extension headers used below in bytes.
 	udpHeader  = 8  // Length of the UDP header in bytes.
 	// A small NTP query packet (UDP)
 	ntpHex = "45b8004c72e94000401125a2646a4100d8ef2304007b007b0038a1a7230209e8000003620000072ed8ef230ce10ff888c730e992e10ffbdbc742a583e10ffbdbcaa4151ae10ffde6c3cf01e3"
 	// Two fragments of a large UDP packet.
 	frag1Hex = "450003fc0001200040117bab646a41005db8d8220afa00000774af62691c476d4d1f5bd3b2d5f17b926562b91de7ab5ee5bea9fe13ed6223891668ab17e4236a4ec1bed53fb9db397f2885e0fd418dbe2f29416b3e01dfa633bd72d1486e6aa39d568a4b9906834ba06d0c39f9696cbbe96c13638c4cef0fedab2f17d9aa3eb87b6fcf7a3e614cbf7cc7141fbf174d97ef220f17d7e669752bad3965785ec1355b19a3adea31a6c148a0b77ade200962dc4f02ad302e1f927c537627dc1f56f613e1a9d69847a8adc5b965059e973312c013f3916f6c54ddedb96605590f9d81e39e3649d007a44e1b57d9086487c073b511da5b868a44ad043e013feb23903eade049bcac0c0486c6e832aabce435a054159242a27784260bdbe8318f677dc58cbcc90f5ec7a065504b8ddd66c5a53480e634deed9b075a9d23dbabd37c97a825e2c6d17b179bbe83a35b09c852db9aa8d04ee23f285d83c68ae808c1a16cb2ed7c93e1d9724c1e0f4e413dfd50814f12d648201bc3352dd87640609937db0eef31c335b182e6969b32a50cd7af1116013caeeccc9417d0918bbfb1320cdb6e215b6a0c70654bb196e99636b70c503d9d1837f1a33f4a43913390f2585b361c33912cf16ccbb0a5cfbba90be9c3a360cf11193b9738b1a1459860e0bb99418df9368174a9184aac6f9ecb1299876ce62ab5028f48cf6c93b58b4fb1ced3199d36ae9dfa4b4eb9109ca62f8b186c912939018a8257b79a93cec689223b04a62de256019d56dbe54ba989b1f22aa00ea81e50b0895b152d7841416e9f5ed209d99cb38534820c82b4298a8d93afdc134aa41a2e3cd62d43419873ac8d17487de28b15e186eefe538c2019023086923b3f9aec506589fb5504f483dd820993f6950262231cb0f914415d37a929a77c435ba3ecdab90a817d683abd4dc8028c3294770d4ee28ea71eb09fc027b9dc9afedc00fbe414eef5756d409909786c82186fce59f4305ad3ca47d72d59d2bff2224f5a2115f01bee7b71552160fefd14587f150a67ffc08e92c73f40d8ad7b6b900324ae56ea84eccdbb2872f644cea1b2e011e862f2dba10dbac8452f53a2c6c9ac9d5b33ab03fa16a1f146197d1c649ee2c65636f4973b916190107b1977fb55f4157ff57e62251d3a3e0fcc3357665c13287009a3f11fc0cfe4495a4b9bb981b0893fd06c938c5d99e3b7e68d6ad16326ea54314d5c6a428cf105bf95aea4e8374bd7ff81ecc5b6b9f050dc6482aa123c470d7c068a2f171949cb5dee61ddf3c40ec97099c527926dddb84b0ffa3f69564bb3b9632da0fc6914a80e2044793ac302e3763d762f42abc07b0ed52968f09e96ce3e5fa83822a5d35548973fdda478610fa39355db82bb4c743479743c32a93521082a131cd21439bca3735c8b01d295c67b8dfe8a0071487d8472"
 	frag2Hex = "450003a00001007d40119b8a646a41005db8d822c726296a575ed8996bdad7392375d166d9894a6f0c0c08e4ae1ae9e55ae13a9f206b15cf74a43bff8f579f85344b972e7298f8c56d6a23081c19a369488a1b680af5f2e96e7d650261ac937ac709b74f45d15aa053b734cea3f5cbf400379a0e30e49bf696640a61a86076d867834cb79e7bcb798d129a28a8d81f47448ddc38b6040bd45607013d839c9198daabf8ae2f2994908e8b5d04f3194fe2def74e95e52aaf313119b9cef0bde9232fb7a95003e5fdcb9d8b759cf52d570c75f885333b600348b93fe8d0ccaa113465e37f20ce72b432ecc9c8a25809c2b2ed201a88d39b7f47023651ed6841e50b8fb298ef703888d603cd02438ac2ca563ae1ee273da555c3929a6221467f122a60bdb6484bd99d22fd4f4f3bfc41fd39e49c090acf33f46544c0705dbeb03b7249d90a398eacfbf239bcbb279e2596b06d25cfb9c6e247c34a57d55a272797f27df4fd2fc0fb23623f7c4890e05133ab2fa4f02cdd44eecabb3a49d7abae7dcb95f1429c82a685c4f69901cf22e355e31916bd20d038efc66dc37387d63a4330c516d03b6a2dd23bb9228d94c225723487792ae62888282a41e8c1c834d68ae58b4db92243671fd171157439282cfbab316439224dfb522f304a788f91c52715dc6588f0e1055455f159a28865d97292a7af670ec78afb229fcfa7cb97590d51d7fc8eb40edef005b19c8fb235f41b3bb5f6f7923b7534bf8ca8437ef93f40fabeb49b9eb9c5e8de9ad27ad8de282cea26adf3ddbd5b3ea4537535e2ddb864b125e73d330bf25d923e3df41be562b8de3bb3ce969defb159bc77cacb2337b07ac5204d8f1a39520089932ca6649a742f63c7e5e2ab25dc4bbed75faf68796dd5d521aee6452fbecc6af63623a1c55ad02de7c727c265ef8a4cdd109d41a7be9a5597dc69c3803e77340f2dff5608817b9c6d7c340c351e451401599a6ede93a0a897bd9bfe2dba1bfc7b61683ee9ff266a8a49fbec63ea60e4a58473c3705404cd3b3ff96415fcc92672a045555f48418a7125f0f4bda7b2df2d367af6d0e9d27a1f3895148c002b1503c6b83efa2a1e93def67fa07937d355b04a193465094e16128f33017e892d0bd154b9b87985eb6571d074d6011863b5af1395972d9415b21bd83d971cf5f3f67cc73dc0ab057aad3c83af4f6b10d5a6d8102ee3fe9f25929a14306871bf579e56dfd69cf45dd1472bbfcb1f0ab7fbb3972e27e2aba98273383b50700872d73f5c2ecf6ce3ea384ec08c4818fcfe0ed86513d617025f52"
+	// A small UDP packet with a hop-by-hop options header (IPv6)
+	udp6Hex = "600000000038004020010db800000000000000000000000120010db8000000000000000000000002110001040000000014e900350030c65129f88512004af0bfa30b8bfa65d33062872dd9ab2fb9d180e3306495311766b8f9630eb97ddc9bb6"
+	// Two fragments of a large IPv6 UDP packet.
+	frag61Hex = "6000000003f82c4020010db800000000000000000000000120010db8000000000000000000000002110000011234abcd14e9003505e44dd73d2d653b899f64c2f772466b06605608aa9cbfc1c79440fa1b5ed8cb31e17d2de4e4c227daf19bd12b6288e7f958090b3f80b86083e7a882d2d7f889f3f5fb48c1fe9cefa5bb53c088a3cbf9509403e61d5d0f39bdb9fe1f624f8907d8fb26f07633bdb94a7ca24913313517f4ec230f412a5287e7ff0a4660e1f5e1e48df42095ba92b8112a8d8f8cf2dce3be102b7f7a1058acbd101a6bddaf27503acc45edfd264125b30f5f4c5e904dc6727140d653a27b02c560a6c3e104cb4577be8b5e4c5444c4261f0614f11e3a33bc101e73d073962ff1271e56e03d395b190fd99282e376676d8e0682a92f10b9bb3b730eb8aedf1ab0470f05ac22f801ed872c8b754340d65d7cc4dbf58a8146991062e5355a3701523d4dc9f2f8f06ec64fea05acd580a34492bdb972029c5a2ad0762d63c2d2404b19f9baa8c78b22854315384f3a2c2c3f6eb3ad517d595e7340f5ea3845e964be4aaa86228c001f0ff5e9a21f058c33c4ac34bf484bbdf0cf094d35e4bf0641f58724f43dcc6557e0a982b1968be7177f01fd825712a4076b9b614e8e1d8b9abf6f57012eb65eb35df471f3c4b73e2cdc1b68e089701cf78188b899dabd30d4538e1fa21d28391fe0dc2e5a86b40020889eb1c6ce273a90fde4839e7b071ac24e7096063686453c0fcc83fa6c238d59454e320c6fa7d6f3f9e7a5e8625a397147c872b4ee8c62730dd07ccb3d11a1baff81dfc09bb8be1dd25c9c94f17b35eb52bbdbefa724e8ddf8063721f6de1e0db3b9525bf524cf3a0fb1778087c5b801b0d69959fcb413086803160ff334d4f7a7f06769bf49386c197289d570b6f3bd4cbd8f611c6666cd17d90c27293c6232f6a95fe16b0470a76d974c030e9535cf6e6ad3ff2ddd57466690d799cd10e06e649877dcb918a1b9b7cfdcb7d1924e8365ee58034c217282ed066c9c1d14fac73fb3a54694018a4289a42cb33d007c9c6a6b23dc0db4a167d0c31b1e5f787f9556835ab7b49272512440e71c3a2914b7bee4cf8d7ad5d8a7e4c37e192fd9c836e6aa583325326069fe7c02b75f1611c90390e23c66f6510107f2b47d4ae2c1d479a76e3bcced186e978b368373a8bb9c8ccddda1e5b2663bd4892977b215273a5007ae09d8164062063b8c576c71356e05a5cb240cb950e54bde8e1ac499f00099954b006c98384101beb63a66b1d0a53862813deadb3ca9b97b06d4853e580b100706a226e11b4e8c8d987e707fa98b501a2d7bee3bcaf9c4aa43254b8c7d1570a20cc3b2ab5ae86c3aa15448624f2a5bf67dd206e2e8103dab04a0f1ef7f22d6cb08f04908ee1c003c2e23556e6763fc7f2e30b73e37f00baa785e38f48375a7336ddd14ac293e3db33f34c120cd4395e6510d77055b39469bdfd02bb1268f7b8cd9be"
+	frag62Hex = "6000000001fc2c4020010db800000000000000000000000120010db8000000000000000000000002110003f01234abcd6ea58cbe3cc4975380d10a59a9d79006d9926e906673f5000fd85de479d9baf8bd656a0d394bea6c47fcbc8d76f14e7c2b651694cf9f685d9b31fe896efd7317772d19dad98d84726936ede378f1e717ddb5629167f652919a9e57ea7f8117aae2adbe457790fb3d2d2421c7b7f62b51901a7a05d61b03e294a2168fc8075e748d0a03ed625fe942855704f6ff4c0c70773cd6513a1662c84e5ffa351d8f2c679876864bbf3899ff76623f9daf01c9fc5dc3dc7fdf09d90ae81fbd1744f3e5f7ace6563625efeaa8b678d8f4d761814aadc4f03b6e1f44f26f4fc2059a88a900c14a9bb3b3249a69f829496ed36a601b0c08e7629ced8301b3225520e6ee1e6f50c609cb746a2edd55329e2cade16b5c5a38c1633256e6063a1968d324eea04abdb455ea45bf26ae9aa4962dd931f8b8e075c57b3d67dd5857c76d0ed9132e1ee4a3233844143498010163a8572e0153ffab19897e7501e8cfe97827b10e3e8ae06693b7cfb3ae0e5f7c8e783ad4fa8864b6230d818372fa9ffc4f20460aac51f4e9524ad4ee7c64cbad0600e3a798317ffcd327b395a54f29ad3d18bc13b5c169ea01d27d8b1630c657b8456aa8067430a8c6cc0561d533523e16d7d1d028c35069c82eab64ac1d8bb7d244e2da9364e2eb24aa8a5763f19daad225dfeffdfa4bf18214379a8fea009b32969e19b835372f9d79"
 )
 
 var ntp, ntpPayload, frag1, frag2, fragPayload []byte
+var udp6, udp6Payload, frag61, frag62, frag6Payload []byte
 
 func decode(s string) []byte {
 	b, err := hex.DecodeString(s)
@@ -43,7 +53,18 @@ func (h *fakeUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr)
 	return nil
 }
 
-func setupUDP(t *testing.T) (LWIPStack, *fakeUDPHandler) {
+// discardUDPHandler drops received packets.
+type discardUDPHandler struct{}
+
+func (discardUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	return nil
+}
+
+func (discardUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	return nil
+}
+
+func setupUDP(t testing.TB) (LWIPStack, *fakeUDPHandler) {
 	// Reinitialize source data before each test to avoid interference.
 	ntp = decode(ntpHex)
 	ntpPayload = ntp[ipv4Header+udpHeader:]
@@ -51,10 +72,21 @@ func setupUDP(t *testing.T) (LWIPStack, *fakeUDPHandler) {
 	frag2 = decode(frag2Hex)
 	fragPayload = append([]byte(nil), frag1[ipv4Header+udpHeader:]...)
 	fragPayload = append(fragPayload, frag2[ipv4Header:]...)
+	udp6 = decode(udp6Hex)
+	udp6Payload = udp6[ipv6Header+ipv6Ext+udpHeader:]
+	frag61 = decode(frag61Hex)
+	frag62 = decode(frag62Hex)
+	frag6Payload = append([]byte(nil), frag61[ipv6Header+ipv6Ext+udpHeader:]...)
+	frag6Payload = append(frag6Payload, frag62[ipv6Header+ipv6Ext:]...)
 
 	// Reset the set of known UDP connections to empty before each test.  Otherwise, the
 	// tests will interfere with each other.
-	udpConns = sync.Map{}
+	// Sessions are closed rather than replacing the map, they may still be
+	// closing, and are counted.
+	udpConns.Range(func(_, c interface{}) bool {
+		c.(*udpConn).Close()
+		return true
+	})
 
 	s := NewLWIPStack()
 	// This channel is buffered because the first Write->ReceiveTo can either be synchronous or
@@ -64,7 +96,7 @@ func setupUDP(t *testing.T) (LWIPStack, *fakeUDPHandler) {
 	return s, h
 }
 
-func write(s LWIPStack, b []byte, t *testing.T) {
+func write(s LWIPStack, b []byte, t testing.TB) {
 	if _, err := s.Write(b); err != nil {
 		t.Fatal(err)
 	}
@@ -89,6 +121,121 @@ func TestUDP(t *testing.T) {
 	assertEqual(<-h.packets, ntpPayload, t)
 }
 
+// echoUDPHandler replies to received packets from ReceiveTo.
+type echoUDPHandler struct {
+	discardUDPHandler
+}
+
+func (echoUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	_, err := conn.WriteFrom(data, addr)
+	return err
+}
+
+// Replying from ReceiveTo, which may be called on the loop goroutine.
+func TestUDPReply(t *testing.T) {
+	s, _ := setupUDP(t)
+	defer s.Close()
+	RegisterUDPConnHandler(echoUDPHandler{})
+	output := make(chan []byte, 1)
+	RegisterOutputFn(func(pkt []byte) (int, error) {
+		output <- append([]byte(nil), pkt...)
+		return len(pkt), nil
+	})
+
+	// The first packet is replied once connected, the second one is
+	// replied on the loop goroutine.
+	for i := 0; i < 2; i++ {
+		write(s, ntp, t)
+		assertEqual((<-output)[ipv4Header+udpHeader:], ntpPayload, t)
+	}
+}
+
+// failingUDPHandler fails to connect with err.
+type failingUDPHandler struct {
+	discardUDPHandler
+	err error
+}
+
+func (h failingUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	return h.err
+}
+
+// Datagrams of sessions failing to connect are replied with ICMP destination
+// unreachable messages quoting them.
+func TestUDPUnreachable(t *testing.T) {
+	setupUDP(t)
+	for _, tc := range []struct {
+		name      string
+		pkt       []byte
+		udpOffset int // Offset of the UDP header in pkt.
+		err       error
+		icmpType  byte
+		icmpCode  byte
+	}{
+		{"port", ntp, ipv4Header, errors.New("refused"), 3, 3},
+		{"host", ntp, ipv4Header, &net.OpError{Op: "dial", Net: "udp", Err: syscall.EHOSTUNREACH}, 3, 1},
+		{"port6", udp6, ipv6Header + ipv6Ext, errors.New("refused"), 1, 4},
+		{"net6", udp6, ipv6Header + ipv6Ext, syscall.ENETUNREACH, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewLWIPStackWithOptions(&StackOptions{UDPUnreachable: true})
+			defer s.Close()
+			RegisterUDPConnHandler(failingUDPHandler{err: tc.err})
+			output := make(chan []byte, 1)
+			RegisterOutputFn(func(pkt []byte) (int, error) {
+				output <- append([]byte(nil), pkt...)
+				return len(pkt), nil
+			})
+			write(s, tc.pkt, t)
+			icmp := <-output
+
+			ipv := ipver(icmp[0] >> 4)
+			iphLen := ipv4Header
+			if ipv == ipv6 {
+				iphLen = ipv6Header
+			}
+			origSrc, origDst := ipAddrs(ipv, tc.pkt)
+			src, dst := ipAddrs(ipv, icmp)
+			if !bytes.Equal(src, origDst) || !bytes.Equal(dst, origSrc) {
+				t.Errorf("wrong addresses %v -> %v", net.IP(src), net.IP(dst))
+			}
+			icmph := icmp[iphLen:]
+			if ipv == ipv4 {
+				if icmp[9] != proto_icmp || checksum(icmp[:iphLen]) != 0 || checksum(icmph) != 0 {
+					t.Error("invalid ICMP message")
+				}
+			} else {
+				sum := pseudoHeaderChecksum(proto_icmpv6, src, dst, len(icmph))
+				if icmp[6] != proto_icmpv6 || checksumFold(checksumAdd(sum, icmph)) != 0xffff {
+					t.Error("invalid ICMPv6 message")
+				}
+			}
+			if icmph[0] != tc.icmpType || icmph[1] != tc.icmpCode {
+				t.Errorf("got type %d code %d, want %d %d", icmph[0], icmph[1], tc.icmpType, tc.icmpCode)
+			}
+			// The datagram is quoted without IPv6 extension headers, and
+			// with its checksum computed again as the one of ntp isn't
+			// valid.
+			quoted, orig := icmph[icmpHeaderLen+iphLen:], tc.pkt[tc.udpOffset:]
+			assertEqual(quoted[:6], orig[:6], t)
+			assertEqual(quoted[udpHeader:], orig[udpHeader:], t)
+		})
+	}
+}
+
+// The context of a handler connecting a UDP session is cancelled when the
+// stack is closed.
+func TestUDPConnectContextClose(t *testing.T) {
+	s, _ := setupUDP(t)
+	h := newCtxHandler()
+	RegisterUDPConnHandler(h)
+	write(s, ntp, t)
+	ctx := <-h.ctxs
+
+	s.Close()
+	waitDone(ctx, context.Canceled, t)
+}
+
 // Send a fragmented UDP packet.
 func TestUDPFragmentation(t *testing.T) {
 	s, h := setupUDP(t)
@@ -132,3 +279,94 @@ func TestUDPFragmentationMemoryAndReordering(t *testing.T) {
 
 	assertEqual(<-h.packets, fragPayload, t)
 }
+
+// Send fragments of a UDP packet in a single batch.
+func TestUDPFragmentationBatch(t *testing.T) {
+	s, h := setupUDP(t)
+	if n, err := s.WriteBatch([][]byte{frag1, frag2}); err != nil || n != 2 {
+		t.Fatalf("WriteBatch returned %v, %v", n, err)
+	}
+	assertEqual(<-h.packets, fragPayload, t)
+}
+
+func TestPeekIPv6(t *testing.T) {
+	setupUDP(t)
+	for _, tc := range []struct {
+		pkt    []byte
+		proto  proto
+		more   bool
+		offset uint16
+	}{
+		{udp6, proto_udp, false, 0},
+		{frag61, proto_udp, true, 0},
+		{frag62, proto_udp, false, 126},
+	} {
+		if p, err := peekNextProto(ipv6, tc.pkt); err != nil || p != tc.proto {
+			t.Errorf("peekNextProto returned %v, %v", p, err)
+		}
+		if more := moreFrags(ipv6, tc.pkt); more != tc.more {
+			t.Errorf("moreFrags returned %v", more)
+		}
+		if offset := fragOffset(ipv6, tc.pkt); offset != tc.offset {
+			t.Errorf("fragOffset returned %v", offset)
+		}
+	}
+	if _, err := peekNextProto(ipv6, udp6[:ipv6Header+1]); err == nil {
+		t.Error("truncated extension header should be an error")
+	}
+}
+
+// Basic test for sending a single IPv6 UDP packet.
+func TestUDPv6(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, udp6, t)
+	assertEqual(<-h.packets, udp6Payload, t)
+}
+
+// Send a fragmented IPv6 UDP packet.
+func TestUDPv6Fragmentation(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, frag61, t)
+	write(s, frag62, t)
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+// Write IPv6 UDP fragments out of order.
+func TestUDPv6FragmentReordering(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, frag62, t)
+	write(s, frag61, t)
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+// Send a fragmented IPv6 UDP packet where fragments reuse the same buffer.
+func TestUDPv6FragmentationMemory(t *testing.T) {
+	s, h := setupUDP(t)
+	buf := make([]byte, len(frag61))
+
+	checkedCopy(buf, frag61, t)
+	write(s, buf[:len(frag61)], t)
+
+	checkedCopy(buf, frag62, t)
+	write(s, buf[:len(frag62)], t)
+
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+// BenchmarkUDPInputParallel measures the input path with several goroutines
+// writing packets to the stack, like the readers of a multi-queue TUN device.
+func BenchmarkUDPInputParallel(b *testing.B) {
+	s, _ := setupUDP(b)
+	defer s.Close()
+	RegisterUDPConnHandler(discardUDPHandler{})
+
+	b.SetBytes(int64(len(ntp)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		pkt := make([]byte, len(ntp))
+		for pb.Next() {
+			copy(pkt, ntp)
+			s.Write(pkt)
+		}
+	})
+}
@@ -0,0 +1,12 @@
+// +build linux darwin
+
+package core
+
+import "syscall"
+
+// Socket errors checked by the stack, besides the syscall constants.
+const (
+	errnoConnReset   = syscall.ECONNRESET
+	errnoHostUnreach = syscall.EHOSTUNREACH
+	errnoNetUnreach  = syscall.ENETUNREACH
+)
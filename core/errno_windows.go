@@ -0,0 +1,17 @@
+// +build windows
+
+package core
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// Sockets report errors with Winsock error codes, rather than the syscall
+// constants.
+const (
+	errnoConnReset   = syscall.WSAECONNRESET
+	errnoHostUnreach = windows.WSAEHOSTUNREACH
+	errnoNetUnreach  = windows.WSAENETUNREACH
+)
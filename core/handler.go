@@ -1,12 +1,16 @@
 package core
 
 import (
+	"context"
 	"net"
+	"time"
 )
 
 // TCPConnHandler handles TCP connections comming from TUN.
 type TCPConnHandler interface {
-	// Handle handles the conn for target.
+	// Handle handles the conn for target. If the stack defers TCP
+	// handshakes, Handle is called before the connection with the client
+	// is established, it must not wait for data from conn before returning.
 	Handle(conn net.Conn, target *net.TCPAddr) error
 }
 
@@ -15,10 +19,91 @@ type UDPConnHandler interface {
 	// Connect connects the proxy server. Note that target can be nil.
 	Connect(conn UDPConn, target *net.UDPAddr) error
 
-	// ReceiveTo will be called when data arrives from TUN.
+	// ReceiveTo will be called when data arrives from TUN. It may be
+	// called on the goroutine owning lwIP and should not block.
 	ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error
 }
 
+// TCPConnContextHandler is a TCPConnHandler taking a context. If the
+// registered TCP handler implements it, HandleContext is called instead of
+// Handle.
+type TCPConnContextHandler interface {
+	// HandleContext handles the conn for target like Handle. ctx is done
+	// once the connection is reset or closed, the stack is closed, or
+	// StackOptions.DialTimeout expires, so that a slow dial can be given
+	// up. It's cancelled when HandleContext returns, it must not be used
+	// for the lifetime of the connection.
+	HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error
+}
+
+// UDPConnContextHandler is a UDPConnHandler taking a context. If the
+// registered UDP handler implements it, ConnectContext is called instead of
+// Connect.
+type UDPConnContextHandler interface {
+	// ConnectContext connects the proxy server like Connect. ctx is done
+	// once the connection is closed, the stack is closed, or
+	// StackOptions.DialTimeout expires. It's cancelled when ConnectContext
+	// returns.
+	ConnectContext(ctx context.Context, conn UDPConn, target *net.UDPAddr) error
+
+	ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error
+}
+
+// TCPContextAdapter adapts a TCPConnContextHandler so that it can be
+// registered as a TCPConnHandler, Handle calls HandleContext with a
+// background context.
+type TCPContextAdapter struct {
+	TCPConnContextHandler
+}
+
+func (a TCPContextAdapter) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return a.HandleContext(context.Background(), conn, target)
+}
+
+func (a TCPContextAdapter) adapted() interface{} {
+	return a.TCPConnContextHandler
+}
+
+// UDPContextAdapter adapts a UDPConnContextHandler so that it can be
+// registered as a UDPConnHandler, Connect calls ConnectContext with a
+// background context.
+type UDPContextAdapter struct {
+	UDPConnContextHandler
+}
+
+func (a UDPContextAdapter) Connect(conn UDPConn, target *net.UDPAddr) error {
+	return a.ConnectContext(context.Background(), conn, target)
+}
+
+func (a UDPContextAdapter) adapted() interface{} {
+	return a.UDPConnContextHandler
+}
+
+// unwrapHandler returns the handler adapted by h if h is an adapter, h
+// otherwise.
+func unwrapHandler(h interface{}) interface{} {
+	if a, ok := h.(interface{ adapted() interface{} }); ok {
+		return a.adapted()
+	}
+	return h
+}
+
+// HandlerCloser is optionally implemented by TCP and UDP connection handlers
+// holding resources, e.g. sessions with the proxy server. Close is called
+// when the stack is closed, before remaining connections are aborted. The
+// handler stays registered and may be used by a stack created afterwards.
+type HandlerCloser interface {
+	Close() error
+}
+
+// UDPConnCloseHandler is optionally implemented by UDP connection handlers
+// to be told when the stack closes a session on its own, i.e. when it's
+// evicted to make room for a new one, so that the proxy resources of the
+// session are released at once. CloseConn is called in a new goroutine.
+type UDPConnCloseHandler interface {
+	CloseConn(conn UDPConn)
+}
+
 var tcpConnHandler TCPConnHandler
 var udpConnHandler UDPConnHandler
 
@@ -29,3 +114,20 @@ func RegisterTCPConnHandler(h TCPConnHandler) {
 func RegisterUDPConnHandler(h UDPConnHandler) {
 	udpConnHandler = h
 }
+
+// stackCtx is done when the current stack is closed, handler contexts are
+// derived from it. dialTimeout is StackOptions.DialTimeout. Both are only
+// accessed by the loop goroutine.
+var (
+	stackCtx    = context.Background()
+	dialTimeout time.Duration
+)
+
+// handlerContext returns the context passed to a handler for a new
+// connection, it runs on the loop goroutine.
+func handlerContext() (context.Context, context.CancelFunc) {
+	if dialTimeout > 0 {
+		return context.WithTimeout(stackCtx, dialTimeout)
+	}
+	return context.WithCancel(stackCtx)
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	proto_icmpv6 = 58
+
+	icmpv4DestUnreach = 3
+	icmpv6DestUnreach = 1
+	icmpHeaderLen     = 8
+	udpHeaderLen      = 8
+
+	// Destination unreachable messages quote as much of the original
+	// packet as fits in the minimum MTU.
+	icmpv4MaxLen = 576
+	icmpv6MaxLen = 1280
+)
+
+// unreachReason is why a destination is unreachable, it's mapped to the
+// ICMP or ICMPv6 code.
+type unreachReason int
+
+const (
+	unreachNet unreachReason = iota
+	unreachHost
+	unreachPort
+	unreachProhibited
+)
+
+func (r unreachReason) code(ipv ipver) byte {
+	if ipv == ipv4 {
+		return [...]byte{unreachNet: 0, unreachHost: 1, unreachPort: 3, unreachProhibited: 13}[r]
+	}
+	// No route, address unreachable, port unreachable, administratively
+	// prohibited.
+	return [...]byte{unreachNet: 0, unreachHost: 3, unreachPort: 4, unreachProhibited: 1}[r]
+}
+
+// unreachError returns why the destination is unreachable according to err
+// returned by a handler, false if err doesn't mean it is.
+func unreachError(err error) (unreachReason, bool) {
+	switch {
+	case errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, errnoHostUnreach):
+		return unreachHost, true
+	case errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, errnoNetUnreach):
+		return unreachNet, true
+	}
+	return 0, false
+}
+
+// buildICMPUnreachable builds a destination unreachable message for the
+// packet orig, from its destination to its source.
+func buildICMPUnreachable(reason unreachReason, orig []byte) ([]byte, error) {
+	ipv, err := peekIPVer(orig)
+	if err != nil {
+		return nil, err
+	}
+	iphLen, maxLen := ipv4HeaderLen, icmpv4MaxLen
+	if ipv == ipv6 {
+		iphLen, maxLen = ipv6HeaderLen, icmpv6MaxLen
+	} else if ipv != ipv4 {
+		return nil, errors.New("unknown IP version")
+	}
+	if len(orig) < iphLen {
+		return nil, errors.New("short IP packet")
+	}
+	if len(orig) > maxLen-iphLen-icmpHeaderLen {
+		orig = orig[:maxLen-iphLen-icmpHeaderLen]
+	}
+
+	pkt := make([]byte, iphLen+icmpHeaderLen+len(orig))
+	origSrc, origDst := ipAddrs(ipv, orig)
+	icmph := pkt[iphLen:]
+	copy(icmph[icmpHeaderLen:], orig)
+	if ipv == ipv4 {
+		pkt[0] = 0x45
+		pkt[8] = 64
+		pkt[9] = proto_icmp
+		copy(pkt[12:16], origDst)
+		copy(pkt[16:20], origSrc)
+		setIPLength(ipv, pkt, len(pkt))
+		icmph[0] = icmpv4DestUnreach
+		icmph[1] = reason.code(ipv)
+		binary.BigEndian.PutUint16(icmph[2:4], checksum(icmph))
+	} else {
+		pkt[0] = 0x60
+		pkt[6] = proto_icmpv6
+		pkt[7] = 64
+		copy(pkt[8:24], origDst)
+		copy(pkt[24:40], origSrc)
+		setIPLength(ipv, pkt, len(pkt))
+		icmph[0] = icmpv6DestUnreach
+		icmph[1] = reason.code(ipv)
+		sum := pseudoHeaderChecksum(proto_icmpv6, pkt[8:24], pkt[24:40], len(icmph))
+		binary.BigEndian.PutUint16(icmph[2:4], ^checksumFold(checksumAdd(sum, icmph)))
+	}
+	return pkt, nil
+}
+
+// newIPPacket returns a packet with an IP header from src to dst for
+// protocol, and its payload of length n.
+func newIPPacket(src, dst net.IP, protocol proto, n int) (pkt, payload []byte) {
+	ipv, iphLen := ipver(ipv4), ipv4HeaderLen
+	srcIP, dstIP := src.To4(), dst.To4()
+	if srcIP == nil || dstIP == nil {
+		ipv, iphLen = ipv6, ipv6HeaderLen
+		srcIP, dstIP = src.To16(), dst.To16()
+	}
+
+	pkt = make([]byte, iphLen+n)
+	if ipv == ipv4 {
+		pkt[0] = 0x45
+		pkt[8] = 64
+		pkt[9] = byte(protocol)
+	} else {
+		pkt[0] = 0x60
+		pkt[6] = byte(protocol)
+		pkt[7] = 64
+	}
+	origSrc, origDst := ipAddrs(ipv, pkt)
+	copy(origSrc, srcIP)
+	copy(origDst, dstIP)
+	setIPLength(ipv, pkt, len(pkt))
+	return pkt, pkt[iphLen:]
+}
+
+// buildTCPSYN builds the headers of the SYN segment of a connection from
+// src to dst with initial sequence number iss, as quoted in ICMP messages.
+func buildTCPSYN(src, dst *net.TCPAddr, iss uint32) []byte {
+	pkt, tcph := newIPPacket(src.IP, dst.IP, proto_tcp, tcpHeaderLen)
+	binary.BigEndian.PutUint16(tcph[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcph[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcph[4:8], iss)
+	tcph[12] = (tcpHeaderLen / 4) << 4
+	tcph[13] = tcpSYN
+	return pkt
+}
+
+// buildUDP builds a datagram from src to dst, as quoted in ICMP messages.
+func buildUDP(src, dst *net.UDPAddr, data []byte) []byte {
+	pkt, udph := newIPPacket(src.IP, dst.IP, proto_udp, udpHeaderLen+len(data))
+	binary.BigEndian.PutUint16(udph[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udph[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udph[4:6], uint16(len(udph)))
+	copy(udph[udpHeaderLen:], data)
+	srcIP, dstIP := ipAddrs(ipver(pkt[0]>>4), pkt)
+	sum := ^checksumFold(checksumAdd(pseudoHeaderChecksum(proto_udp, srcIP, dstIP, len(udph)), udph))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udph[6:8], sum)
+	return pkt
+}
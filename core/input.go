@@ -4,12 +4,126 @@ package core
 #cgo CFLAGS: -I./c/include
 #include "lwip/pbuf.h"
 #include "lwip/tcp.h"
+#include "lwip/priv/tcp_priv.h"
+#include <stdlib.h>
+#include <string.h>
 
 err_t
 input(struct pbuf *p)
 {
 	return (*netif_list).input(p, netif_list);
 }
+
+// A pbuf referencing the memory of a packet being input, that memory is
+// only valid during the call to input_ref().
+struct ref_pbuf {
+	struct pbuf_custom pc;
+	char *mem; // The referenced memory.
+	u16_t len;
+	int owned; // Whether mem was allocated by relocate_ref_pbuf().
+};
+
+static void
+free_ref_pbuf(struct pbuf *p)
+{
+	struct ref_pbuf *rp = (struct ref_pbuf *)p;
+	if (rp->owned) {
+		free(rp->mem);
+	}
+	free(rp);
+}
+
+struct pbuf *
+new_ref_pbuf(void *mem, u16_t len)
+{
+	struct ref_pbuf *rp = (struct ref_pbuf *)malloc(sizeof(struct ref_pbuf));
+	if (rp == NULL) {
+		return NULL;
+	}
+	rp->pc.custom_free_function = free_ref_pbuf;
+	rp->mem = (char *)mem;
+	rp->len = len;
+	rp->owned = 0;
+	return pbuf_alloced_custom(PBUF_RAW, len, PBUF_REF, &rp->pc, mem, len);
+}
+
+// Memory set aside for a relocation whose allocation fails, large enough
+// for any packet. It's only accessed by the loop goroutine.
+#define SPARE_MEM_LEN 0xffff
+static char *spare_mem;
+
+// relocate_ref_pbuf copies the referenced memory to memory owned by the
+// pbuf, fixing pointers lwIP may hold into it. Out of sequence TCP segments
+// are the only ones pointing into pbufs kept by lwIP. It takes the spare
+// memory if the allocation fails.
+static void
+relocate_ref_pbuf(struct ref_pbuf *rp)
+{
+	struct tcp_pcb *pcb;
+	struct tcp_seg *seg;
+	char *mem;
+	ptrdiff_t delta;
+
+	mem = (char *)malloc(rp->len);
+	if (mem == NULL) {
+		mem = spare_mem;
+		spare_mem = NULL;
+	}
+	memcpy(mem, rp->mem, rp->len);
+	delta = mem - rp->mem;
+	for (pcb = tcp_active_pcbs; pcb != NULL; pcb = pcb->next) {
+		for (seg = pcb->ooseq; seg != NULL; seg = seg->next) {
+			if ((char *)seg->tcphdr >= rp->mem && (char *)seg->tcphdr < rp->mem + rp->len) {
+				seg->tcphdr = (struct tcp_hdr *)((char *)seg->tcphdr + delta);
+			}
+		}
+	}
+	rp->pc.pbuf.payload = (char *)rp->pc.pbuf.payload + delta;
+	rp->mem = mem;
+	rp->owned = 1;
+}
+
+// input_ref inputs a pbuf created by new_ref_pbuf(), the data is relocated
+// if lwIP keeps a reference to the pbuf, e.g. for refused or out of sequence
+// TCP data. The pbuf is always consumed.
+//
+// The relocation can't fail once lwIP holds the pbuf, so the spare memory is
+// replenished first. If that fails, the data is copied to a pbuf owned by
+// lwIP, or the packet is dropped.
+err_t
+input_ref(struct pbuf *p)
+{
+	struct pbuf *q;
+	err_t err;
+
+	if (spare_mem == NULL && (spare_mem = (char *)malloc(SPARE_MEM_LEN)) == NULL) {
+		q = pbuf_alloc(PBUF_RAW, p->tot_len, PBUF_RAM);
+		if (q != NULL && pbuf_copy(q, p) != ERR_OK) {
+			pbuf_free(q);
+			q = NULL;
+		}
+		pbuf_free(p);
+		if (q == NULL) {
+			return ERR_MEM;
+		}
+		err = input(q);
+		if (err != ERR_OK) {
+			pbuf_free(q);
+		}
+		return err;
+	}
+
+	pbuf_ref(p);
+	err = input(p);
+	if (err != ERR_OK) {
+		pbuf_free(p);
+	}
+	if (p->ref > 1) {
+		relocate_ref_pbuf((struct ref_pbuf *)p);
+	}
+	pbuf_free(p);
+	return err;
+}
 */
 import "C"
 import (
@@ -40,6 +154,49 @@ func peekIPVer(p []byte) (ipver, error) {
 	return ipver((p[0] & 0xf0) >> 4), nil
 }
 
+// IPv6 extension headers preceding the upper-layer header.
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6DestOpts = 60
+)
+
+// walkIPv6Headers skips the extension headers of an IPv6 packet, it returns
+// the upper-layer protocol and the fragment header if there is one.
+func walkIPv6Headers(p []byte) (proto, []byte, error) {
+	if len(p) < ipv6HeaderLen {
+		return 0, nil, errors.New("short IPv6 packet")
+	}
+	next := p[6]
+	off := ipv6HeaderLen
+	var fragHdr []byte
+	for {
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOpts:
+			if len(p) < off+2 {
+				return 0, nil, errors.New("short IPv6 extension header")
+			}
+			next = p[off]
+			off += (int(p[off+1]) + 1) * 8
+		case ipv6Fragment:
+			if len(p) < off+8 {
+				return 0, nil, errors.New("short IPv6 fragment header")
+			}
+			fragHdr = p[off : off+8]
+			next = p[off]
+			off += 8
+			if binary.BigEndian.Uint16(fragHdr[2:4])>>3 != 0 {
+				// Headers following the fragment header are only
+				// in the first fragment.
+				return proto(next), fragHdr, nil
+			}
+		default:
+			return proto(next), fragHdr, nil
+		}
+	}
+}
+
 func moreFrags(ipv ipver, p []byte) bool {
 	switch ipv {
 	case ipv4:
@@ -47,9 +204,14 @@ func moreFrags(ipv ipver, p []byte) bool {
 			return true
 		}
 	case ipv6:
-		// FIXME Just too lazy to implement this for IPv6, for now
-		// returning true simply indicate do the copy anyway.
-		return true
+		_, fragHdr, err := walkIPv6Headers(p)
+		if err != nil {
+			// Let lwIP deal with it, with the data copied.
+			return true
+		}
+		if fragHdr != nil && (fragHdr[3]&0x01) > 0 /* has M (More Fragments) flag set */ {
+			return true
+		}
 	}
 	return false
 }
@@ -59,10 +221,11 @@ func fragOffset(ipv ipver, p []byte) uint16 {
 	case ipv4:
 		return binary.BigEndian.Uint16(p[6:8]) & 0x1fff
 	case ipv6:
-		// FIXME Just too lazy to implement this for IPv6, for now
-		// returning a value greater than 0 simply indicate do the
-		// copy anyway.
-		return 1
+		_, fragHdr, err := walkIPv6Headers(p)
+		if err != nil || fragHdr == nil {
+			return 0
+		}
+		return binary.BigEndian.Uint16(fragHdr[2:4]) >> 3
 	}
 	return 0
 }
@@ -70,58 +233,126 @@ func fragOffset(ipv ipver, p []byte) uint16 {
 func peekNextProto(ipv ipver, p []byte) (proto, error) {
 	switch ipv {
 	case ipv4:
-		if len(p) < 9 {
+		if len(p) < ipv4HeaderLen {
 			return 0, errors.New("short IPv4 packet")
 		}
 		return proto(p[9]), nil
 	case ipv6:
-		if len(p) < 6 {
-			return 0, errors.New("short IPv6 packet")
-		}
-		return proto(p[6]), nil
+		next, _, err := walkIPv6Headers(p)
+		return next, err
 	default:
 		return 0, errors.New("unknown IP version")
 	}
 }
 
-func input(pkt []byte) (int, error) {
-	if len(pkt) == 0 {
-		return 0, nil
-	}
-
+// newInputPbuf wraps an IP packet in a pbuf ready to be passed to lwIP.
+//
+// Allocating and filling the pbuf does not touch any lwIP state that
+// requires the lwIP thread (lwIP is built with MEM_LIBC_MALLOC and
+// MEMP_MEM_MALLOC), it's done by the writer so that the loop goroutine
+// only does the actual packet processing.
+func newInputPbuf(pkt []byte) (*C.struct_pbuf, error) {
 	ipv, err := peekIPVer(pkt)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	nextProto, err := peekNextProto(ipv, pkt)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
-
 	var buf *C.struct_pbuf
 
-	if nextProto == proto_udp && !(moreFrags(ipv, pkt) || fragOffset(ipv, pkt) > 0) {
-		// Copying data is not necessary for unfragmented UDP packets, and we would like to
-		// have all data in one pbuf.
-		buf = C.pbuf_alloc_reference(unsafe.Pointer(&pkt[0]), C.u16_t(len(pkt)), C.PBUF_REF)
+	if (nextProto == proto_udp || nextProto == proto_tcp) && !(moreFrags(ipv, pkt) || fragOffset(ipv, pkt) > 0) {
+		// Copying data is not necessary for unfragmented UDP and TCP
+		// packets unless lwIP keeps them, which is dealt with in
+		// inputPbuf, and we would like to have all data in one pbuf.
+		buf = C.new_ref_pbuf(unsafe.Pointer(&pkt[0]), C.u16_t(len(pkt)))
+		if buf == nil {
+			return nil, errors.New("pbuf allocation failed")
+		}
 	} else {
-		// TODO Copy the data only when lwip need to keep it, e.g. in
-		// case we are returning ERR_CONN in tcpRecvFn.
+		// Fragments are always kept by lwIP for reassembly.
 		//
 		// Allocating from PBUF_POOL results in a pbuf chain that may
 		// contain multiple pbufs.
 		buf = C.pbuf_alloc(C.PBUF_RAW, C.u16_t(len(pkt)), C.PBUF_POOL)
+		if buf == nil {
+			return nil, errors.New("pbuf allocation failed")
+		}
 		C.pbuf_take(buf, unsafe.Pointer(&pkt[0]), C.u16_t(len(pkt)))
 	}
+	return buf, nil
+}
+
+// inputPbuf passes a pbuf to lwIP, it runs on the loop goroutine.
+func inputPbuf(buf *C.struct_pbuf) error {
+	if buf.flags&C.PBUF_FLAG_IS_CUSTOM != 0 {
+		if ierr := C.input_ref(buf); ierr != C.ERR_OK {
+			return errors.New("packet not handled")
+		}
+		return nil
+	}
 
 	ierr := C.input(buf)
 	if ierr != C.ERR_OK {
 		C.pbuf_free(buf)
-		return 0, errors.New("packet not handled")
+		return errors.New("packet not handled")
+	}
+	return nil
+}
+
+func input(pkt []byte) (int, error) {
+	if len(pkt) == 0 {
+		return 0, nil
+	}
+
+	buf, err := newInputPbuf(pkt)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := loop.input(buf); err != nil {
+		return 0, err
 	}
 	return len(pkt), nil
 }
+
+// inputBatch passes several packets to lwIP in a single command of the loop
+// goroutine. It returns the number of packets accepted by lwIP, and the first
+// error encountered, packets following a failed one are still processed.
+func inputBatch(pkts [][]byte) (int, error) {
+	bufs := make([]*C.struct_pbuf, len(pkts))
+	var firstErr error
+	for i, pkt := range pkts {
+		if len(pkt) == 0 {
+			continue
+		}
+		buf, err := newInputPbuf(pkt)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		bufs[i] = buf
+	}
+
+	n := 0
+	loop.call(func() {
+		for _, buf := range bufs {
+			if buf == nil {
+				continue
+			}
+			if err := inputPbuf(buf); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			n++
+		}
+	})
+	return n, firstErr
+}
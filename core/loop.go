@@ -0,0 +1,192 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/include
+#include "lwip/sys.h"
+#include "lwip/timeouts.h"
+#include "lwip/ip4_frag.h"
+#include "lwip/ip6_frag.h"
+#include "lwip/priv/tcp_priv.h"
+
+// timeouts_needed returns whether lwIP timers have anything to do. Cyclic
+// timers are always pending, but they only have work while there are TCP
+// connections or datagrams being reassembled.
+static int
+timeouts_needed(void)
+{
+	return tcp_active_pcbs != NULL || tcp_tw_pcbs != NULL || ip_reass_pending() || ip6_reass_pending();
+}
+*/
+import "C"
+import (
+	"sync"
+	"time"
+)
+
+// lwIP runs in a single thread, the loop goroutine owns it and is the only
+// one calling into lwIP.
+var loop = newEventLoop()
+
+// eventLoop runs commands submitted by other goroutines and lwIP timers on a
+// single goroutine. Commands run in the order they are submitted. The timer
+// is armed for the next lwIP timeout after running commands, and stopped
+// while there is nothing to do. Packets
+// output by lwIP while running a set of queued commands are collected if a
+// batch output function is registered, and are flushed in one call before
+// waiting callers are released.
+//
+// lwIP callbacks, and thus TCPConn callback methods and UDP handlers'
+// ReceiveTo, run on the loop goroutine. Code running on the loop goroutine
+// calls lwIP directly and must not block, it must never call call() or
+// input(), which wait for the loop, post() can be used from anywhere.
+type eventLoop struct {
+	mu    sync.Mutex
+	queue []lwipCmd
+	wake  chan struct{}
+
+	// Only accessed by the loop goroutine.
+	spare  []lwipCmd
+	timer  *time.Timer
+	armed  bool   // Whether the timer is armed.
+	due    uint32 // The sys_now() time the timer is armed for.
+	stacks int    // Number of open stacks, timers only run if non-zero.
+}
+
+// lwipCmd is either a function to run or a packet to input.
+type lwipCmd struct {
+	fn   func()
+	buf  *C.struct_pbuf
+	done chan error // Receives the result, nil if nobody waits.
+	err  error
+}
+
+var donePool = sync.Pool{
+	New: func() interface{} {
+		return make(chan error, 1)
+	},
+}
+
+func newEventLoop() *eventLoop {
+	l := &eventLoop{
+		wake: make(chan struct{}, 1),
+	}
+	l.timer = time.AfterFunc(time.Hour, l.checkTimeouts)
+	l.timer.Stop()
+	return l
+}
+
+func (l *eventLoop) submit(cmd lwipCmd) {
+	l.mu.Lock()
+	l.queue = append(l.queue, cmd)
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *eventLoop) wait(cmd lwipCmd) error {
+	cmd.done = donePool.Get().(chan error)
+	l.submit(cmd)
+	err := <-cmd.done
+	donePool.Put(cmd.done)
+	return err
+}
+
+// post runs fn on the loop goroutine without waiting for it.
+func (l *eventLoop) post(fn func()) {
+	l.submit(lwipCmd{fn: fn})
+}
+
+// call runs fn on the loop goroutine and waits for it to return. It must not
+// be called from the loop goroutine.
+func (l *eventLoop) call(fn func()) {
+	l.wait(lwipCmd{fn: fn})
+}
+
+// input passes buf to lwIP and waits for it to be processed. It must not be
+// called from the loop goroutine.
+func (l *eventLoop) input(buf *C.struct_pbuf) error {
+	return l.wait(lwipCmd{buf: buf})
+}
+
+func (l *eventLoop) run() {
+	for range l.wake {
+		l.runQueued()
+	}
+}
+
+// checkTimeouts is run by the timer on its own goroutine.
+func (l *eventLoop) checkTimeouts() {
+	l.post(func() {
+		l.armed = false
+		if l.stacks > 0 {
+			C.sys_check_timeouts()
+		}
+	})
+}
+
+// schedule arms the timer for the next lwIP timeout, or stops it if there is
+// nothing to do.
+func (l *eventLoop) schedule() {
+	sleep := C.u32_t(C.SYS_TIMEOUTS_SLEEPTIME_INFINITE)
+	if l.stacks > 0 && C.timeouts_needed() != 0 {
+		sleep = C.sys_timeouts_sleeptime()
+	}
+	if sleep == C.SYS_TIMEOUTS_SLEEPTIME_INFINITE {
+		if l.armed {
+			l.timer.Stop()
+			l.armed = false
+		}
+		return
+	}
+	due := uint32(C.sys_now() + sleep)
+	if l.armed && due == l.due {
+		return
+	}
+	l.timer.Reset(time.Duration(sleep) * time.Millisecond)
+	l.armed = true
+	l.due = due
+}
+
+func (l *eventLoop) runQueued() {
+	l.mu.Lock()
+	cmds := l.queue
+	l.queue = l.spare[:0]
+	l.mu.Unlock()
+
+	for i := range cmds {
+		cmd := &cmds[i]
+		if cmd.fn != nil {
+			cmd.fn()
+		} else if cmd.buf != nil {
+			cmd.err = inputPbuf(cmd.buf)
+		}
+	}
+	l.schedule()
+	flushOutput()
+
+	for i := range cmds {
+		if cmds[i].done != nil {
+			cmds[i].done <- cmds[i].err
+		}
+		cmds[i] = lwipCmd{}
+	}
+	l.spare = cmds[:0]
+}
+
+// startTimers is called on the loop goroutine when a stack is opened. Timers
+// didn't run while no stack was open, they are rebased to the current time
+// rather than all firing at once.
+func (l *eventLoop) startTimers() {
+	if l.stacks == 0 {
+		C.sys_restart_timeouts()
+	}
+	l.stacks++
+}
+
+// stopTimers is called on the loop goroutine when a stack is closed, the
+// timer is stopped once commands have run if no stack is left.
+func (l *eventLoop) stopTimers() {
+	l.stacks--
+}
@@ -5,100 +5,153 @@ package core
 #include "lwip/tcp.h"
 #include "lwip/udp.h"
 #include "lwip/timeouts.h"
+#include "lwip/priv/tcp_priv.h"
+#include "lwip/ip4_frag.h"
+#include "lwip/ip6_frag.h"
+
+// reset_state frees state left in lwIP once connections were closed, i.e.
+// TCP pcbs waiting for the last acknowledgment or in TIME_WAIT, and
+// datagrams being reassembled, so that a new stack starts from scratch.
+void
+reset_state(void)
+{
+	while (tcp_active_pcbs != NULL) {
+		tcp_abort(tcp_active_pcbs);
+	}
+	while (tcp_tw_pcbs != NULL) {
+		tcp_abort(tcp_tw_pcbs);
+	}
+	ip_reass_free_all();
+	ip6_reass_free_all();
+}
 */
 import "C"
 import (
 	"context"
 	"errors"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
 )
 
+// Deprecated: lwIP timers are now checked when the next timeout is due.
 const CHECK_TIMEOUTS_INTERVAL = 250 // in millisecond
 const TCP_POLL_INTERVAL = 8         // poll every 4 seconds
 
 type LWIPStack interface {
 	Write([]byte) (int, error)
+	WriteBatch([][]byte) (int, error)
 	Close() error
+	CloseContext(ctx context.Context) error
 	RestartTimeouts()
 }
 
-// lwIP runs in a single thread, locking is needed in Go runtime.
-var lwipMutex = &sync.Mutex{}
-
 type lwipStack struct {
 	tpcb *C.struct_tcp_pcb
 	upcb *C.struct_udp_pcb
 
-	ctx    context.Context
-	cancel context.CancelFunc
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeErr  error
 }
 
+// refuseConns is set while the stack is being closed, new TCP connections
+// and UDP sessions are refused. It's only accessed by the loop goroutine.
+var refuseConns bool
+
 // NewLWIPStack listens for any incoming connections/packets and registers
 // corresponding accept/recv callback functions.
 func NewLWIPStack() LWIPStack {
+	return NewLWIPStackWithOptions(nil)
+}
+
+// NewLWIPStackWithOptions is like NewLWIPStack, with opts applied to the
+// stack. A nil opts means default options. It panics if opts are invalid.
+func NewLWIPStackWithOptions(opts *StackOptions) LWIPStack {
+	if err := opts.validate(); err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &lwipStack{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	var perr string
+	loop.call(func() {
+		stackCtx = ctx
+		currentStack = s
+		s.tpcb, s.upcb, perr = listen(opts)
+	})
+	if perr != "" {
+		cancel()
+		panic(perr)
+	}
+	return s
+}
+
+// listen applies opts, and creates the listening pcbs, it runs on the loop
+// goroutine and returns an error message on failure.
+func listen(opts *StackOptions) (*C.struct_tcp_pcb, *C.struct_udp_pcb, string) {
+	opts.apply()
+	refuseConns = false
+
 	tcpPCB := C.tcp_new()
 	if tcpPCB == nil {
-		panic("tcp_new return nil")
+		return nil, nil, "tcp_new return nil"
 	}
 
+	// Allocated pcbs are freed on errors, the pools are fixed.
 	err := C.tcp_bind(tcpPCB, C.IP_ADDR_ANY, 0)
 	switch err {
 	case C.ERR_OK:
 		break
 	case C.ERR_VAL:
-		panic("invalid PCB state")
+		C.tcp_close(tcpPCB)
+		return nil, nil, "invalid PCB state"
 	case C.ERR_USE:
-		panic("port in use")
+		C.tcp_close(tcpPCB)
+		return nil, nil, "port in use"
 	default:
-		C.memp_free(C.MEMP_TCP_PCB, unsafe.Pointer(tcpPCB))
-		panic("unknown tcp_bind return value")
+		C.tcp_close(tcpPCB)
+		return nil, nil, "unknown tcp_bind return value"
 	}
 
-	tcpPCB = C.tcp_listen_with_backlog(tcpPCB, C.TCP_DEFAULT_LISTEN_BACKLOG)
-	if tcpPCB == nil {
-		panic("can not allocate tcp pcb")
+	// The pcb is left alone if the listening one can't be allocated.
+	listenPCB := C.tcp_listen_with_backlog(tcpPCB, C.TCP_DEFAULT_LISTEN_BACKLOG)
+	if listenPCB == nil {
+		C.tcp_close(tcpPCB)
+		return nil, nil, "can not allocate tcp pcb"
 	}
+	tcpPCB = listenPCB
 
 	setTCPAcceptCallback(tcpPCB)
 
 	udpPCB := C.udp_new()
 	if udpPCB == nil {
-		panic("could not allocate udp pcb")
+		C.tcp_close(tcpPCB)
+		return nil, nil, "could not allocate udp pcb"
 	}
 
 	err = C.udp_bind(udpPCB, C.IP_ADDR_ANY, 0)
 	if err != C.ERR_OK {
-		panic("address already in use")
+		C.udp_remove(udpPCB)
+		C.tcp_close(tcpPCB)
+		return nil, nil, "address already in use"
 	}
 
 	setUDPRecvCallback(udpPCB, nil)
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	go func() {
-		for {
-			select {
-			case <-time.After(CHECK_TIMEOUTS_INTERVAL * time.Millisecond):
-				lwipMutex.Lock()
-				C.sys_check_timeouts()
-				lwipMutex.Unlock()
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
-	return &lwipStack{
-		tpcb:   tcpPCB,
-		upcb:   udpPCB,
-		ctx:    ctx,
-		cancel: cancel,
-	}
+	loop.startTimers()
+	return tcpPCB, udpPCB, ""
 }
 
-// Write writes IP packets to the stack.
+// Write writes IP packets to the stack. It is safe to call Write from
+// multiple goroutines, e.g. one reader for each queue of a multi-queue TUN
+// device.
 func (s *lwipStack) Write(data []byte) (int, error) {
 	select {
 	case <-s.ctx.Done():
@@ -108,24 +161,85 @@ func (s *lwipStack) Write(data []byte) (int, error) {
 	}
 }
 
+// WriteBatch writes several IP packets to the stack, they are processed
+// in a single command of the lwIP goroutine. It returns the number of
+// packets accepted by the stack.
+func (s *lwipStack) WriteBatch(pkts [][]byte) (int, error) {
+	select {
+	case <-s.ctx.Done():
+		return 0, errors.New("stack closed")
+	default:
+		return inputBatch(pkts)
+	}
+}
+
 // RestartTimeouts rebases the timeout times to the current time.
 //
 // This is necessary if sys_check_timeouts() hasn't been called for a long
 // time (e.g. while saving energy) to prevent all timer functions of that
 // period being called.
 func (s *lwipStack) RestartTimeouts() {
-	lwipMutex.Lock()
-	C.sys_restart_timeouts()
-	lwipMutex.Unlock()
+	loop.call(func() {
+		C.sys_restart_timeouts()
+	})
 }
 
 // Close closes the stack.
 //
-// Timer events will be canceled and existing connections will be closed.
-// Note this function will not free objects allocated in lwIP initialization
-// stage, e.g. the loop interface.
+// Handlers implementing HandlerCloser are closed, timer events will be
+// canceled and existing connections will be closed. lwIP is initialized once
+// per process, but the state of connections is freed, so a new stack can be
+// created once Close returns.
 func (s *lwipStack) Close() error {
-	// Stop firing timer events.
+	s.closeOnce.Do(s.close)
+	return s.closeErr
+}
+
+// CloseContext closes the stack gracefully. New connections are refused, FIN
+// segments are sent to TUN peers, and connections are given until ctx is done
+// to finish, i.e. for handlers to relay data in flight and for peers to close
+// their side. The stack is then closed as by Close.
+//
+// It returns ctx.Err() if connections did not finish in time, otherwise the
+// error closing handlers, if any.
+func (s *lwipStack) CloseContext(ctx context.Context) error {
+	err := s.drain(ctx)
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// drain closes the writing side of all TCP connections and waits for them to
+// be closed.
+func (s *lwipStack) drain(ctx context.Context) error {
+	loop.call(func() {
+		refuseConns = true
+	})
+	tcpConns.Range(func(_, c interface{}) bool {
+		c.(*tcpConn).CloseWrite()
+		return true
+	})
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&tcpConnCount) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (s *lwipStack) close() {
+	loop.call(func() {
+		refuseConns = true
+	})
+	s.closeErr = closeHandlers()
+
+	// Stop accepting packets.
 	s.cancel()
 
 	// Abort and close all TCP and UDP connections.
@@ -134,23 +248,38 @@ func (s *lwipStack) Close() error {
 		return true
 	})
 	udpConns.Range(func(_, c interface{}) bool {
-		// This only closes UDP connections in the core,
-		// UDP connections in the handler will wait till
-		// timeout, they are not closed immediately for
-		// now.
 		c.(*udpConn).Close()
 		return true
 	})
 
-	// Remove callbacks and close listening pcbs.
-	lwipMutex.Lock()
-	C.tcp_accept(s.tpcb, nil)
-	C.udp_recv(s.upcb, nil, nil)
-	C.tcp_close(s.tpcb) // FIXME handle error
-	C.udp_remove(s.upcb)
-	lwipMutex.Unlock()
+	// Remove callbacks, free pcbs and stop firing timer events.
+	loop.call(func() {
+		C.reset_state()
+		C.tcp_accept(s.tpcb, nil)
+		C.udp_recv(s.upcb, nil, nil)
+		C.tcp_close(s.tpcb) // FIXME handle error
+		C.udp_remove(s.upcb)
+		loop.stopTimers()
+	})
+}
 
-	return nil
+// closeHandlers closes registered handlers implementing HandlerCloser, a
+// handler registered for both TCP and UDP is closed once.
+func closeHandlers() error {
+	var err error
+	tcpCloser, _ := unwrapHandler(tcpConnHandler).(HandlerCloser)
+	if tcpCloser != nil {
+		err = tcpCloser.Close()
+	}
+	if udpCloser, ok := unwrapHandler(udpConnHandler).(HandlerCloser); ok {
+		if tcpCloser != nil && reflect.TypeOf(tcpCloser).Comparable() && tcpCloser == udpCloser {
+			return err
+		}
+		if cerr := udpCloser.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func init() {
@@ -166,5 +295,7 @@ func init() {
 	lwipInit()
 
 	// Set MTU.
-	C.netif_list.mtu = 1500
+	setMTU(DefaultMTU)
+
+	go loop.run()
 }
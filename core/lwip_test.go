@@ -0,0 +1,46 @@
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// Stacks can be closed and created again, nothing is left from the previous
+// one.
+func TestStackRestart(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		h := &fakeTCPHandler{}
+		s, p := setupTCP(t, h)
+		RegisterUDPConnHandler(discardUDPHandler{})
+		if timerArmed() {
+			t.Fatalf("round %d: timer armed without connections", i)
+		}
+
+		p.connect()
+		conn := <-h.conns
+		payload := []byte("hello")
+		write(s, p.segment(payload), t)
+		assertEqual(<-readN(conn, len(payload)), payload, t)
+		// Queued but never read.
+		write(s, p.segment(payload), t)
+
+		write(s, decode(ntpHex), t)
+		// Fragments being reassembled.
+		write(s, decode(frag1Hex), t)
+		write(s, decode(frag61Hex), t)
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&tcpConnCount); n != 0 {
+			t.Fatalf("round %d: %d TCP connections left", i, n)
+		}
+		udpConns.Range(func(k, _ interface{}) bool {
+			t.Fatalf("round %d: UDP connection %v left", i, k)
+			return false
+		})
+		if _, err := s.Write(decode(ntpHex)); err == nil {
+			t.Fatalf("round %d: write to a closed stack", i)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnMetadata describes a TCP connection or UDP session comming from TUN.
+// It's created by the stack along with the connection, and shared by the
+// layers handling it, e.g. routing, logging and authentication, which can
+// attach values to it with SetTag.
+type ConnMetadata struct {
+	// Source is the address of the client, on the TUN side.
+	Source net.Addr
+
+	// Destination is the address the client connects to, or sends the
+	// first datagram to.
+	Destination net.Addr
+
+	// IPVersion is 4 or 6.
+	IPVersion int
+
+	// Interface is StackOptions.InterfaceName of the accepting stack.
+	Interface string
+
+	// Stack is the stack which accepted the connection.
+	Stack LWIPStack
+
+	// Start is when the first packet of the connection was received.
+	Start time.Time
+
+	mu       sync.Mutex
+	hostname string
+	tags     map[string]interface{}
+}
+
+// Values of the current stack set in new metadata, only accessed by the loop
+// goroutine.
+var (
+	currentStack  LWIPStack
+	interfaceName string
+)
+
+// newConnMetadata returns the metadata of a connection from src to dst, it
+// runs on the loop goroutine.
+func newConnMetadata(src, dst net.Addr, dstIP net.IP) *ConnMetadata {
+	ipv := 6
+	if dstIP.To4() != nil {
+		ipv = 4
+	}
+	return &ConnMetadata{
+		Source:      src,
+		Destination: dst,
+		IPVersion:   ipv,
+		Interface:   interfaceName,
+		Stack:       currentStack,
+		Start:       time.Now(),
+	}
+}
+
+// Hostname returns the hostname sniffed from the first data the client sent
+// on a TCP connection, i.e. the server name of a TLS ClientHello or the Host
+// header of an HTTP request. It's empty until the data is received, or if
+// none was found. Data is sniffed as it arrives, while the TCP handler
+// runs too.
+func (m *ConnMetadata) Hostname() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hostname
+}
+
+func (m *ConnMetadata) setHostname(hostname string) {
+	m.mu.Lock()
+	m.hostname = hostname
+	m.mu.Unlock()
+}
+
+// Tag returns the value attached to the connection with key.
+func (m *ConnMetadata) Tag(key string) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.tags[key]
+	return v, ok
+}
+
+// SetTag attaches value to the connection with key, replacing any previous
+// value.
+func (m *ConnMetadata) SetTag(key string, value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tags == nil {
+		m.tags = make(map[string]interface{})
+	}
+	m.tags[key] = value
+}
+
+// Tags returns a copy of the values attached to the connection.
+func (m *ConnMetadata) Tags() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tags := make(map[string]interface{}, len(m.tags))
+	for k, v := range m.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// MetadataOf returns the metadata of conn if it's a TCPConn or UDPConn, or a
+// connection wrapping one which also has a Metadata method, nil otherwise.
+func MetadataOf(conn interface{}) *ConnMetadata {
+	if c, ok := conn.(interface{ Metadata() *ConnMetadata }); ok {
+		return c.Metadata()
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record sent by a client for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer c.Close()
+
+	rec := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(s, rec); err != nil {
+		t.Fatal(err)
+	}
+	rec = append(rec, make([]byte, binary.BigEndian.Uint16(rec[3:5]))...)
+	if _, err := io.ReadFull(s, rec[tlsRecordHeaderLen:]); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestSniffHostname(t *testing.T) {
+	hello := clientHello(t, "Example.com")
+	for _, tc := range []struct {
+		data     string
+		hostname string
+	}{
+		{string(hello), "example.com"},
+		{string(hello[:len(hello)-10]), ""},
+		{string(clientHello(t, "")), ""},
+		{"GET / HTTP/1.1\r\nUser-Agent: test\r\nHost: Example.com\r\n\r\n", "example.com"},
+		{"POST /x HTTP/1.1\r\nhost:example.com:8080\r\n\r\n", "example.com"},
+		{"GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "2001:db8::1"},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n\r\nHost: example.com\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: exam", ""},
+		{"GET / HTTP/1.1", ""},
+		{"SSH-2.0-OpenSSH\r\nHost: example.com\r\n", ""},
+		{"", ""},
+	} {
+		if hostname := sniffHostname([]byte(tc.data)); hostname != tc.hostname {
+			t.Errorf("sniffed %q from %q, want %q", hostname, tc.data, tc.hostname)
+		}
+	}
+}
+
+func TestTCPMetadata(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCPWithOptions(t, h, &StackOptions{InterfaceName: "tun0"})
+	defer s.Close()
+	p.connect()
+	conn := <-h.conns
+
+	m := MetadataOf(conn)
+	if m == nil {
+		t.Fatal("no metadata")
+	}
+	if m.Source.String() != "10.0.0.1:1000" || m.Destination.String() != "10.0.0.2:80" {
+		t.Errorf("wrong addresses %v -> %v", m.Source, m.Destination)
+	}
+	if m.IPVersion != 4 || m.Interface != "tun0" || m.Stack != s || m.Start.IsZero() {
+		t.Errorf("wrong metadata %+v", m)
+	}
+	if m.Hostname() != "" {
+		t.Error("hostname sniffed before data was received")
+	}
+
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	write(s, p.segment(request), t)
+	assertEqual(<-readN(conn, len(request)), request, t)
+	if hostname := m.Hostname(); hostname != "example.com" {
+		t.Errorf("sniffed %q", hostname)
+	}
+
+	m.SetTag("route", "direct")
+	if v, ok := MetadataOf(conn).Tag("route"); !ok || v != "direct" {
+		t.Errorf("got tag %v, %v", v, ok)
+	}
+	if _, ok := m.Tag("user"); ok {
+		t.Error("unexpected tag")
+	}
+	tags := m.Tags()
+	tags["user"] = "x"
+	if len(m.Tags()) != 1 {
+		t.Error("Tags did not return a copy")
+	}
+}
+
+// The hostname is sniffed from data sent while the handler runs.
+func TestTCPHostnameInHandler(t *testing.T) {
+	s, p := setupTCP(t, &fakeTCPHandler{})
+	defer s.Close()
+	started := make(chan struct{})
+	hostnames := make(chan string, 1)
+	conns := make(chan net.Conn, 1)
+	RegisterTCPConnHandler(TCPHandlerFunc(func(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+		close(started)
+		m := MetadataOf(conn)
+		for deadline := time.Now().Add(time.Second); m.Hostname() == "" && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		hostnames <- m.Hostname()
+		conns <- conn
+		return nil
+	}))
+
+	p.connect()
+	<-started
+	hello := clientHello(t, "example.com")
+	write(s, p.segment(hello), t)
+	if hostname := <-hostnames; hostname != "example.com" {
+		t.Errorf("sniffed %q in the handler", hostname)
+	}
+	// The data refused while the handler ran is received afterwards.
+	assertEqual(<-readN(<-conns, len(hello)), hello, t)
+}
+
+// connsUDPHandler passes connected sessions to conns.
+type connsUDPHandler struct {
+	discardUDPHandler
+	conns chan UDPConn
+}
+
+func (h connsUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	h.conns <- conn
+	return nil
+}
+
+func TestUDPMetadata(t *testing.T) {
+	s, _ := setupUDP(t)
+	defer s.Close()
+	h := connsUDPHandler{conns: make(chan UDPConn, 1)}
+	RegisterUDPConnHandler(h)
+
+	write(s, ntp, t)
+	m := (<-h.conns).Metadata()
+	if m.Source.String() != "100.106.65.0:123" || m.Destination.String() != "216.239.35.4:123" {
+		t.Errorf("wrong addresses %v -> %v", m.Source, m.Destination)
+	}
+	if m.IPVersion != 4 || m.Stack != s || m.Start.IsZero() {
+		t.Errorf("wrong metadata %+v", m)
+	}
+
+	write(s, udp6, t)
+	m = (<-h.conns).Metadata()
+	if m.Source.String() != "[2001:db8::1]:5353" || m.IPVersion != 6 {
+		t.Errorf("wrong metadata %+v", m)
+	}
+}
@@ -0,0 +1,294 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// TCPMiddleware wraps a TCP handler, e.g. to log, count or refuse
+// connections before passing them to next.
+type TCPMiddleware func(next TCPConnHandler) TCPConnHandler
+
+// UDPMiddleware wraps a UDP handler.
+type UDPMiddleware func(next UDPConnHandler) UDPConnHandler
+
+// TCPHandlerFunc is a TCP handler function taking a context, it implements
+// both TCPConnHandler and TCPConnContextHandler. Middlewares pass
+// connections on with HandleTCP so that the context reaches the next
+// handler.
+type TCPHandlerFunc func(ctx context.Context, conn net.Conn, target *net.TCPAddr) error
+
+func (f TCPHandlerFunc) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return f(context.Background(), conn, target)
+}
+
+func (f TCPHandlerFunc) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	return f(ctx, conn, target)
+}
+
+// UDPHandlerFuncs implements both UDPConnHandler and UDPConnContextHandler
+// with functions.
+type UDPHandlerFuncs struct {
+	ConnectFunc   func(ctx context.Context, conn UDPConn, target *net.UDPAddr) error
+	ReceiveToFunc func(conn UDPConn, data []byte, addr *net.UDPAddr) error
+}
+
+func (h UDPHandlerFuncs) Connect(conn UDPConn, target *net.UDPAddr) error {
+	return h.ConnectFunc(context.Background(), conn, target)
+}
+
+func (h UDPHandlerFuncs) ConnectContext(ctx context.Context, conn UDPConn, target *net.UDPAddr) error {
+	return h.ConnectFunc(ctx, conn, target)
+}
+
+func (h UDPHandlerFuncs) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	return h.ReceiveToFunc(conn, data, addr)
+}
+
+// HandleTCP passes conn to h, with ctx if h implements
+// TCPConnContextHandler.
+func HandleTCP(ctx context.Context, h TCPConnHandler, conn net.Conn, target *net.TCPAddr) error {
+	if ch, ok := h.(TCPConnContextHandler); ok {
+		return ch.HandleContext(ctx, conn, target)
+	}
+	return h.Handle(conn, target)
+}
+
+// ConnectUDP connects conn with h, with ctx if h implements
+// UDPConnContextHandler.
+func ConnectUDP(ctx context.Context, h UDPConnHandler, conn UDPConn, target *net.UDPAddr) error {
+	if ch, ok := h.(UDPConnContextHandler); ok {
+		return ch.ConnectContext(ctx, conn, target)
+	}
+	return h.Connect(conn, target)
+}
+
+// ChainTCP returns h wrapped by mws. The first middleware is the outermost
+// one, i.e. it sees new connections first. Closing the stack closes h if it
+// implements HandlerCloser.
+func ChainTCP(h TCPConnHandler, mws ...TCPMiddleware) TCPConnHandler {
+	outer := h
+	for i := len(mws) - 1; i >= 0; i-- {
+		outer = mws[i](outer)
+	}
+	return chainedTCPHandler{outer: outer, base: h}
+}
+
+// ChainUDP returns h wrapped by mws, like ChainTCP.
+func ChainUDP(h UDPConnHandler, mws ...UDPMiddleware) UDPConnHandler {
+	outer := h
+	for i := len(mws) - 1; i >= 0; i-- {
+		outer = mws[i](outer)
+	}
+	return chainedUDPHandler{outer: outer, base: h}
+}
+
+// UseTCPMiddleware wraps the registered TCP handler with mws, as by
+// ChainTCP. It must be called after the handler is registered.
+func UseTCPMiddleware(mws ...TCPMiddleware) {
+	if tcpConnHandler == nil {
+		panic("must register a TCP connection handler")
+	}
+	tcpConnHandler = ChainTCP(tcpConnHandler, mws...)
+}
+
+// UseUDPMiddleware wraps the registered UDP handler with mws, as by
+// ChainUDP. It must be called after the handler is registered.
+func UseUDPMiddleware(mws ...UDPMiddleware) {
+	if udpConnHandler == nil {
+		panic("must register a UDP connection handler")
+	}
+	udpConnHandler = ChainUDP(udpConnHandler, mws...)
+}
+
+type chainedTCPHandler struct {
+	outer TCPConnHandler
+	base  TCPConnHandler
+}
+
+func (c chainedTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return c.outer.Handle(conn, target)
+}
+
+func (c chainedTCPHandler) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	return HandleTCP(ctx, c.outer, conn, target)
+}
+
+func (c chainedTCPHandler) adapted() interface{} {
+	return unwrapHandler(c.base)
+}
+
+type chainedUDPHandler struct {
+	outer UDPConnHandler
+	base  UDPConnHandler
+}
+
+func (c chainedUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error {
+	return c.outer.Connect(conn, target)
+}
+
+func (c chainedUDPHandler) ConnectContext(ctx context.Context, conn UDPConn, target *net.UDPAddr) error {
+	return ConnectUDP(ctx, c.outer, conn, target)
+}
+
+func (c chainedUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	return c.outer.ReceiveTo(conn, data, addr)
+}
+
+func (c chainedUDPHandler) adapted() interface{} {
+	return unwrapHandler(c.base)
+}
+
+// connString describes a connection in logs, with its sniffed hostname if
+// any.
+func connString(conn interface{}, src, dst net.Addr) string {
+	if m := MetadataOf(conn); m != nil {
+		if hostname := m.Hostname(); hostname != "" {
+			return fmt.Sprintf("%v -> %v (%s)", src, dst, hostname)
+		}
+	}
+	return fmt.Sprintf("%v -> %v", src, dst)
+}
+
+// LogTCP logs connections and whether the next handler accepted them.
+func LogTCP() TCPMiddleware {
+	return func(next TCPConnHandler) TCPConnHandler {
+		return TCPHandlerFunc(func(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+			start := time.Now()
+			err := HandleTCP(ctx, next, conn, target)
+			if err != nil {
+				log.Warnf("TCP connection %s failed after %v: %v", connString(conn, conn.LocalAddr(), target), time.Since(start), err)
+			} else {
+				log.Infof("TCP connection %s accepted in %v", connString(conn, conn.LocalAddr(), target), time.Since(start))
+			}
+			return err
+		})
+	}
+}
+
+// LogUDP logs sessions and whether the next handler connected them.
+func LogUDP() UDPMiddleware {
+	return func(next UDPConnHandler) UDPConnHandler {
+		return UDPHandlerFuncs{
+			ConnectFunc: func(ctx context.Context, conn UDPConn, target *net.UDPAddr) error {
+				start := time.Now()
+				err := ConnectUDP(ctx, next, conn, target)
+				if err != nil {
+					log.Warnf("UDP session %s failed after %v: %v", connString(conn, conn.LocalAddr(), target), time.Since(start), err)
+				} else {
+					log.Infof("UDP session %s connected in %v", connString(conn, conn.LocalAddr(), target), time.Since(start))
+				}
+				return err
+			},
+			ReceiveToFunc: next.ReceiveTo,
+		}
+	}
+}
+
+// recovered turns a panic into an error, it must be deferred.
+func recovered(what string, err *error) {
+	if r := recover(); r != nil {
+		log.Errorf("panic %s: %v\n%s", what, r, debug.Stack())
+		*err = fmt.Errorf("panic %s: %v", what, r)
+	}
+}
+
+// RecoverTCP recovers from panics of the next handler, the connection is
+// then refused as if the handler returned an error.
+func RecoverTCP() TCPMiddleware {
+	return func(next TCPConnHandler) TCPConnHandler {
+		return TCPHandlerFunc(func(ctx context.Context, conn net.Conn, target *net.TCPAddr) (err error) {
+			defer recovered("handling TCP connection", &err)
+			return HandleTCP(ctx, next, conn, target)
+		})
+	}
+}
+
+// RecoverUDP recovers from panics of the next handler, in Connect as well as
+// ReceiveTo, which may run on the goroutine owning lwIP.
+func RecoverUDP() UDPMiddleware {
+	return func(next UDPConnHandler) UDPConnHandler {
+		return UDPHandlerFuncs{
+			ConnectFunc: func(ctx context.Context, conn UDPConn, target *net.UDPAddr) (err error) {
+				defer recovered("connecting UDP session", &err)
+				return ConnectUDP(ctx, next, conn, target)
+			},
+			ReceiveToFunc: func(conn UDPConn, data []byte, addr *net.UDPAddr) (err error) {
+				defer recovered("sending UDP data", &err)
+				return next.ReceiveTo(conn, data, addr)
+			},
+		}
+	}
+}
+
+// Metrics counts connections going through the metrics middlewares. Fields
+// are updated atomically, use Snapshot to read them. It implements
+// expvar.Var.
+type Metrics struct {
+	TCPConns    int64 // TCP connections passed to the next handler.
+	TCPErrors   int64 // TCP connections the next handler failed.
+	UDPSessions int64 // UDP sessions passed to the next handler.
+	UDPErrors   int64 // UDP sessions the next handler failed to connect.
+	UDPPackets  int64 // Datagrams passed to the next handler.
+	UDPBytes    int64 // Payload bytes of these datagrams.
+}
+
+// Snapshot returns a copy of m.
+func (m *Metrics) Snapshot() Metrics {
+	return Metrics{
+		TCPConns:    atomic.LoadInt64(&m.TCPConns),
+		TCPErrors:   atomic.LoadInt64(&m.TCPErrors),
+		UDPSessions: atomic.LoadInt64(&m.UDPSessions),
+		UDPErrors:   atomic.LoadInt64(&m.UDPErrors),
+		UDPPackets:  atomic.LoadInt64(&m.UDPPackets),
+		UDPBytes:    atomic.LoadInt64(&m.UDPBytes),
+	}
+}
+
+// String returns a snapshot of m in JSON.
+func (m *Metrics) String() string {
+	b, _ := json.Marshal(m.Snapshot())
+	return string(b)
+}
+
+// MetricsTCP counts TCP connections in m.
+func MetricsTCP(m *Metrics) TCPMiddleware {
+	return func(next TCPConnHandler) TCPConnHandler {
+		return TCPHandlerFunc(func(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+			atomic.AddInt64(&m.TCPConns, 1)
+			err := HandleTCP(ctx, next, conn, target)
+			if err != nil {
+				atomic.AddInt64(&m.TCPErrors, 1)
+			}
+			return err
+		})
+	}
+}
+
+// MetricsUDP counts UDP sessions and datagrams in m.
+func MetricsUDP(m *Metrics) UDPMiddleware {
+	return func(next UDPConnHandler) UDPConnHandler {
+		return UDPHandlerFuncs{
+			ConnectFunc: func(ctx context.Context, conn UDPConn, target *net.UDPAddr) error {
+				atomic.AddInt64(&m.UDPSessions, 1)
+				err := ConnectUDP(ctx, next, conn, target)
+				if err != nil {
+					atomic.AddInt64(&m.UDPErrors, 1)
+				}
+				return err
+			},
+			ReceiveToFunc: func(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+				atomic.AddInt64(&m.UDPPackets, 1)
+				atomic.AddInt64(&m.UDPBytes, int64(len(data)))
+				return next.ReceiveTo(conn, data, addr)
+			},
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type ctxKey struct{}
+
+// Middlewares run in order, and the context reaches the handler.
+func TestChainTCP(t *testing.T) {
+	var order []string
+	mw := func(name string) TCPMiddleware {
+		return func(next TCPConnHandler) TCPConnHandler {
+			return TCPHandlerFunc(func(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+				order = append(order, name)
+				return HandleTCP(ctx, next, conn, target)
+			})
+		}
+	}
+	base := TCPHandlerFunc(func(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+		order = append(order, "base")
+		if ctx.Value(ctxKey{}) == nil {
+			t.Error("context not passed")
+		}
+		return nil
+	})
+
+	h := ChainTCP(base, mw("a"), mw("b"))
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	if err := HandleTCP(ctx, h, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[0] != "a" || order[1] != "b" || order[2] != "base" {
+		t.Errorf("got order %v", order)
+	}
+}
+
+// A panic of the handler is recovered, the connection is reset.
+func TestRecoverTCP(t *testing.T) {
+	RegisterTCPConnHandler(TCPHandlerFunc(func(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+		panic("handler bug")
+	}))
+	UseTCPMiddleware(RecoverTCP())
+	s := NewLWIPStack()
+	defer s.Close()
+	p := newTCPPeer(t, s)
+	p.connect()
+	p.waitRST()
+}
+
+func TestRecoverUDP(t *testing.T) {
+	h := RecoverUDP()(UDPHandlerFuncs{
+		ConnectFunc: func(ctx context.Context, conn UDPConn, target *net.UDPAddr) error {
+			panic("handler bug")
+		},
+		ReceiveToFunc: func(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+			panic("handler bug")
+		},
+	})
+	if err := h.Connect(nil, nil); err == nil {
+		t.Error("Connect did not fail")
+	}
+	if err := h.ReceiveTo(nil, nil, nil); err == nil {
+		t.Error("ReceiveTo did not fail")
+	}
+}
+
+func TestMetricsUDP(t *testing.T) {
+	s, h := setupUDP(t)
+	defer s.Close()
+	m := new(Metrics)
+	UseUDPMiddleware(MetricsUDP(m))
+	write(s, ntp, t)
+	<-h.packets
+
+	want := Metrics{UDPSessions: 1, UDPPackets: 1, UDPBytes: int64(len(ntpPayload))}
+	if got := m.Snapshot(); got != want {
+		t.Errorf("got metrics %v, want %v", m, want)
+	}
+}
+
+func TestMetricsTCP(t *testing.T) {
+	m := new(Metrics)
+	h := MetricsTCP(m)(TCPHandlerFunc(func(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+		return errors.New("refused")
+	}))
+	h.Handle(nil, nil)
+	if got := m.Snapshot(); got.TCPConns != 1 || got.TCPErrors != 1 {
+		t.Errorf("got metrics %v", m)
+	}
+}
+
+// closerHandler is a TCP and UDP handler counting calls to Close.
+type closerHandler struct {
+	discardUDPHandler
+	closed int32
+}
+
+func (h *closerHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return nil
+}
+
+func (h *closerHandler) Close() error {
+	atomic.AddInt32(&h.closed, 1)
+	return nil
+}
+
+// A handler registered for TCP and UDP is closed once, through middlewares.
+func TestChainClose(t *testing.T) {
+	h := &closerHandler{}
+	RegisterTCPConnHandler(ChainTCP(h, LogTCP()))
+	RegisterUDPConnHandler(ChainUDP(h, LogUDP()))
+	s := NewLWIPStack()
+	s.Close()
+	if n := atomic.LoadInt32(&h.closed); n != 1 {
+		t.Errorf("handler closed %d times", n)
+	}
+}
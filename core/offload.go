@@ -0,0 +1,429 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Segmentation offloads with virtio-net headers.
+//
+// A Linux TUN device opened with IFF_VNET_HDR and TCP offloads enabled
+// (TUNSETOFFLOAD) prefixes every packet with a virtio-net header. Packets
+// read from such a device can be TCP super-segments of up to 64KB which
+// must be split into MSS sized segments before being input to lwIP, and
+// consecutive TCP segments output by lwIP can be coalesced into
+// super-segments before being written to the device, so that the kernel
+// handles segmentation and checksumming.
+//
+// See also:
+// https://github.com/torvalds/linux/blob/master/include/uapi/linux/virtio_net.h
+
+// VirtioNetHdrLen is the length of struct virtio_net_hdr.
+const VirtioNetHdrLen = 10
+
+const (
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+
+	// Offset of the checksum field in the TCP header.
+	tcpChecksumOffset = 16
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+	tcpURG = 0x20
+	tcpECE = 0x40
+	tcpCWR = 0x80
+
+	// Maximum length of an IPv4 packet, or of the payload of an IPv6 packet.
+	maxIPPacketLen = 65535
+)
+
+// VirtioNetHdr is the header prepended to packets read from or written to a
+// TUN device opened with IFF_VNET_HDR. Fields are in little endian byte order
+// on the wire, which is the byte order of the host on all supported platforms.
+type VirtioNetHdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+// Decode decodes the header from b.
+func (h *VirtioNetHdr) Decode(b []byte) error {
+	if len(b) < VirtioNetHdrLen {
+		return errors.New("short virtio-net header")
+	}
+	h.Flags = b[0]
+	h.GSOType = b[1]
+	h.HdrLen = binary.LittleEndian.Uint16(b[2:4])
+	h.GSOSize = binary.LittleEndian.Uint16(b[4:6])
+	h.CsumStart = binary.LittleEndian.Uint16(b[6:8])
+	h.CsumOffset = binary.LittleEndian.Uint16(b[8:10])
+	return nil
+}
+
+// Encode encodes the header into b.
+func (h *VirtioNetHdr) Encode(b []byte) error {
+	if len(b) < VirtioNetHdrLen {
+		return errors.New("short buffer for virtio-net header")
+	}
+	b[0] = h.Flags
+	b[1] = h.GSOType
+	binary.LittleEndian.PutUint16(b[2:4], h.HdrLen)
+	binary.LittleEndian.PutUint16(b[4:6], h.GSOSize)
+	binary.LittleEndian.PutUint16(b[6:8], h.CsumStart)
+	binary.LittleEndian.PutUint16(b[8:10], h.CsumOffset)
+	return nil
+}
+
+// SplitGSO splits frame, a packet prefixed with a virtio-net header, into
+// plain IP packets ready to be written to the stack. Packets are built in
+// bufs, which are resliced to the length of each packet, the number of
+// packets is returned. A frame not carrying a super-segment results in a
+// single packet, with its checksum completed if the kernel left it partial.
+func SplitGSO(frame []byte, bufs [][]byte) (int, error) {
+	var hdr VirtioNetHdr
+	if err := hdr.Decode(frame); err != nil {
+		return 0, err
+	}
+	pkt := frame[VirtioNetHdrLen:]
+	if len(bufs) == 0 {
+		return 0, errors.New("no buffer for packets")
+	}
+
+	switch hdr.GSOType &^ virtioNetHdrGSOECN {
+	case virtioNetHdrGSONone:
+		if cap(bufs[0]) < len(pkt) {
+			return 0, errors.New("buffer too short for packet")
+		}
+		bufs[0] = bufs[0][:len(pkt)]
+		copy(bufs[0], pkt)
+		if hdr.Flags&virtioNetHdrFNeedsCsum != 0 {
+			start, offset := int(hdr.CsumStart), int(hdr.CsumOffset)
+			if start+offset+2 > len(pkt) {
+				return 0, errors.New("invalid checksum offsets")
+			}
+			// The checksum field holds the pseudo header checksum.
+			binary.BigEndian.PutUint16(bufs[0][start+offset:], checksum(bufs[0][start:]))
+		}
+		return 1, nil
+	case virtioNetHdrGSOTCPv4, virtioNetHdrGSOTCPv6:
+		return splitTCP(&hdr, pkt, bufs)
+	default:
+		return 0, errors.New("unsupported GSO type")
+	}
+}
+
+func splitTCP(hdr *VirtioNetHdr, pkt []byte, bufs [][]byte) (int, error) {
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return 0, err
+	}
+	if (ipv == ipv4 && hdr.GSOType&^virtioNetHdrGSOECN != virtioNetHdrGSOTCPv4) ||
+		(ipv == ipv6 && hdr.GSOType&^virtioNetHdrGSOECN != virtioNetHdrGSOTCPv6) {
+		return 0, errors.New("GSO type does not match IP version")
+	}
+	// CsumStart is the offset of the TCP header, it accounts for IPv4
+	// options and IPv6 extension headers.
+	iphLen := int(hdr.CsumStart)
+	if (ipv == ipv4 && iphLen < ipv4HeaderLen) || (ipv == ipv6 && iphLen < ipv6HeaderLen) || len(pkt) < iphLen+tcpHeaderLen {
+		return 0, errors.New("invalid TCP super-segment")
+	}
+	tcphLen := int(pkt[iphLen+12]>>4) * 4
+	hdrLen := iphLen + tcphLen
+	if tcphLen < tcpHeaderLen || len(pkt) < hdrLen {
+		return 0, errors.New("invalid TCP header")
+	}
+	gsoSize := int(hdr.GSOSize)
+	if gsoSize == 0 {
+		return 0, errors.New("invalid GSO size")
+	}
+
+	src, dst := ipAddrs(ipv, pkt)
+	seq := binary.BigEndian.Uint32(pkt[iphLen+4:])
+	flags := pkt[iphLen+13]
+	var id uint16
+	if ipv == ipv4 {
+		id = binary.BigEndian.Uint16(pkt[4:6])
+	}
+
+	payload := pkt[hdrLen:]
+	n := 0
+	for off := 0; off < len(payload); n++ {
+		end := off + gsoSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if n >= len(bufs) {
+			return 0, errors.New("too many segments")
+		}
+		segLen := hdrLen + end - off
+		if cap(bufs[n]) < segLen {
+			return 0, errors.New("buffer too short for segment")
+		}
+		seg := bufs[n][:segLen]
+		bufs[n] = seg
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[off:end])
+
+		if ipv == ipv4 {
+			binary.BigEndian.PutUint16(seg[4:6], id+uint16(n))
+		}
+		setIPLength(ipv, seg, segLen)
+
+		tcph := seg[iphLen:]
+		binary.BigEndian.PutUint32(tcph[4:8], seq+uint32(off))
+		segFlags := flags
+		if end != len(payload) {
+			segFlags &^= tcpFIN | tcpPSH
+		}
+		if off != 0 {
+			segFlags &^= tcpCWR
+		}
+		tcph[13] = segFlags
+		tcph[16], tcph[17] = 0, 0
+		sum := pseudoHeaderChecksum(proto_tcp, src, dst, len(tcph))
+		binary.BigEndian.PutUint16(tcph[16:18], ^checksumFold(checksumAdd(sum, tcph)))
+
+		off = end
+	}
+	return n, nil
+}
+
+// tcpSegment describes a TCP segment considered for coalescing.
+type tcpSegment struct {
+	pkt     []byte
+	ipv     ipver
+	iphLen  int
+	tcphLen int
+	seq     uint32
+	flags   uint8
+}
+
+func (s *tcpSegment) payloadLen() int {
+	return len(s.pkt) - s.iphLen - s.tcphLen
+}
+
+// parseTCPSegment parses pkt as a TCP segment without IPv4 options or
+// fragmentation, and without IPv6 extension headers.
+func parseTCPSegment(pkt []byte) (tcpSegment, bool) {
+	s := tcpSegment{pkt: pkt}
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return s, false
+	}
+	var iphLen int
+	switch ipv {
+	case ipv4:
+		if len(pkt) < ipv4HeaderLen || pkt[0]&0x0f != 5 || pkt[9] != proto_tcp ||
+			moreFrags(ipv, pkt) || fragOffset(ipv, pkt) > 0 ||
+			int(binary.BigEndian.Uint16(pkt[2:4])) != len(pkt) {
+			return s, false
+		}
+		iphLen = ipv4HeaderLen
+	case ipv6:
+		if len(pkt) < ipv6HeaderLen || pkt[6] != proto_tcp ||
+			int(binary.BigEndian.Uint16(pkt[4:6]))+ipv6HeaderLen != len(pkt) {
+			return s, false
+		}
+		iphLen = ipv6HeaderLen
+	default:
+		return s, false
+	}
+	if len(pkt) < iphLen+tcpHeaderLen {
+		return s, false
+	}
+	tcph := pkt[iphLen:]
+	tcphLen := int(tcph[12]>>4) * 4
+	if tcphLen < tcpHeaderLen || len(pkt) < iphLen+tcphLen {
+		return s, false
+	}
+	s.ipv = ipv
+	s.iphLen = iphLen
+	s.tcphLen = tcphLen
+	s.seq = binary.BigEndian.Uint32(tcph[4:8])
+	s.flags = tcph[13]
+	return s, true
+}
+
+// coalescable reports whether the segment can be part of a super-segment: it
+// must carry a payload, and no other flag than ACK and PSH.
+func (s *tcpSegment) coalescable() bool {
+	return s.payloadLen() > 0 && s.flags&tcpACK != 0 && s.flags&^(tcpACK|tcpPSH) == 0
+}
+
+// sameFlow reports whether a and b belong to the same TCP connection and
+// direction.
+func sameFlow(a, b *tcpSegment) bool {
+	if a.ipv != b.ipv {
+		return false
+	}
+	asrc, adst := ipAddrs(a.ipv, a.pkt)
+	bsrc, bdst := ipAddrs(b.ipv, b.pkt)
+	return bytes.Equal(asrc, bsrc) && bytes.Equal(adst, bdst) &&
+		bytes.Equal(a.pkt[a.iphLen:a.iphLen+4], b.pkt[b.iphLen:b.iphLen+4])
+}
+
+// canAppend reports whether the headers of b allow it to be appended to a
+// super-segment starting with a: IP fields other than lengths, identification
+// and checksum must be equal, and so must the TCP acknowledgement number,
+// window, data offset and options.
+func canAppend(a, b *tcpSegment) bool {
+	if a.tcphLen != b.tcphLen {
+		return false
+	}
+	if a.ipv == ipv4 {
+		// TOS, flags and TTL.
+		if a.pkt[1] != b.pkt[1] || a.pkt[6] != b.pkt[6] || a.pkt[8] != b.pkt[8] {
+			return false
+		}
+	} else {
+		// Traffic class, flow label and hop limit.
+		if !bytes.Equal(a.pkt[0:4], b.pkt[0:4]) || a.pkt[7] != b.pkt[7] {
+			return false
+		}
+	}
+	at, bt := a.pkt[a.iphLen:], b.pkt[b.iphLen:]
+	return bytes.Equal(at[8:12], bt[8:12]) && bytes.Equal(at[14:16], bt[14:16]) &&
+		bytes.Equal(at[tcpHeaderLen:a.tcphLen], bt[tcpHeaderLen:b.tcphLen])
+}
+
+// superSegment is a sequence of coalesced TCP segments.
+type superSegment struct {
+	first    tcpSegment
+	payloads [][]byte
+	gsoSize  int
+	totalLen int
+	nextSeq  uint32
+	psh      bool
+	closed   bool
+}
+
+// append tries to append s to the super-segment.
+func (ss *superSegment) append(s *tcpSegment) bool {
+	if ss.closed || s.seq != ss.nextSeq || s.payloadLen() > ss.gsoSize ||
+		ss.totalLen+s.payloadLen() > maxIPPacketLen || !canAppend(&ss.first, s) {
+		return false
+	}
+	payload := s.pkt[s.iphLen+s.tcphLen:]
+	ss.payloads = append(ss.payloads, payload)
+	ss.totalLen += len(payload)
+	ss.nextSeq += uint32(len(payload))
+	if s.flags&tcpPSH != 0 {
+		ss.psh = true
+	}
+	// Only the last segment of a super-segment can be shorter than the
+	// segmentation size, or carry PSH.
+	if len(payload) < ss.gsoSize || ss.psh {
+		ss.closed = true
+	}
+	return true
+}
+
+// CoalesceTCP coalesces consecutive TCP segments of the same flow found in
+// pkts into super-segments, and calls write for every resulting packet. A
+// packet is passed to write as a list of buffers to be written as a whole to
+// a TUN device opened with IFF_VNET_HDR, the first buffer being the
+// virtio-net header. Buffers are only valid during the call, pkts must not be
+// modified until CoalesceTCP returns.
+func CoalesceTCP(pkts [][]byte, write func(bufs [][]byte) error) error {
+	items := make([]*superSegment, 0, len(pkts))
+
+	for _, pkt := range pkts {
+		s, ok := parseTCPSegment(pkt)
+		if !ok {
+			items = append(items, &superSegment{first: s, closed: true})
+			continue
+		}
+		if !s.coalescable() {
+			// The packet becomes the latest one of its flow, following
+			// segments won't be appended to a super-segment preceding
+			// it, keeping packets of the flow in order.
+			items = append(items, &superSegment{first: s, closed: true})
+			continue
+		}
+		merged := false
+		for i := len(items) - 1; i >= 0; i-- {
+			if items[i].first.iphLen != 0 && sameFlow(&items[i].first, &s) {
+				merged = items[i].append(&s)
+				break
+			}
+		}
+		if !merged {
+			payloadLen := s.payloadLen()
+			items = append(items, &superSegment{
+				first:    s,
+				gsoSize:  payloadLen,
+				totalLen: len(pkt),
+				nextSeq:  s.seq + uint32(payloadLen),
+				psh:      s.flags&tcpPSH != 0,
+				closed:   s.flags&tcpPSH != 0,
+			})
+		}
+	}
+
+	vnetHdr := make([]byte, VirtioNetHdrLen)
+	var head []byte
+	bufs := make([][]byte, 0, 3)
+	for _, item := range items {
+		bufs = bufs[:0]
+		if len(item.payloads) == 0 {
+			// A single packet, checksums are already computed.
+			for i := range vnetHdr {
+				vnetHdr[i] = 0
+			}
+			bufs = append(bufs, vnetHdr, item.first.pkt)
+		} else {
+			s := &item.first
+			hdrLen := s.iphLen + s.tcphLen
+			head = append(head[:0], s.pkt[:hdrLen]...)
+			setIPLength(s.ipv, head, item.totalLen)
+
+			// The kernel expects the TCP checksum field to hold the
+			// pseudo header checksum when completing it.
+			tcph := head[s.iphLen:]
+			if item.psh {
+				tcph[13] |= tcpPSH
+			}
+			src, dst := ipAddrs(s.ipv, head)
+			sum := pseudoHeaderChecksum(proto_tcp, src, dst, item.totalLen-s.iphLen)
+			binary.BigEndian.PutUint16(tcph[tcpChecksumOffset:], checksumFold(sum))
+
+			hdr := VirtioNetHdr{
+				Flags:      virtioNetHdrFNeedsCsum,
+				HdrLen:     uint16(hdrLen),
+				GSOSize:    uint16(item.gsoSize),
+				CsumStart:  uint16(s.iphLen),
+				CsumOffset: tcpChecksumOffset,
+			}
+			if s.ipv == ipv4 {
+				hdr.GSOType = virtioNetHdrGSOTCPv4
+			} else {
+				hdr.GSOType = virtioNetHdrGSOTCPv6
+			}
+			hdr.Encode(vnetHdr)
+			bufs = append(bufs, vnetHdr, head, s.pkt[hdrLen:])
+			bufs = append(bufs, item.payloads...)
+		}
+		if err := write(bufs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildTCPv4 builds an IPv4 TCP segment from 10.0.0.1:1000 to 10.0.0.2:80.
+func buildTCPv4(seq uint32, flags uint8, payload []byte) []byte {
+	return buildTCPv4Ack(seq, 1, flags, payload)
+}
+
+// buildTCPv4Ack is like buildTCPv4 with the acknowledgment number set to ack.
+func buildTCPv4Ack(seq, ack uint32, flags uint8, payload []byte) []byte {
+	pkt := make([]byte, ipv4HeaderLen+tcpHeaderLen+len(payload))
+	pkt[0] = 0x45
+	pkt[6] = 0x40 // DF
+	pkt[8] = 64
+	pkt[9] = proto_tcp
+	copy(pkt[12:16], []byte{10, 0, 0, 1})
+	copy(pkt[16:20], []byte{10, 0, 0, 2})
+	setIPLength(ipv4, pkt, len(pkt))
+
+	tcph := pkt[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(tcph[0:2], 1000)
+	binary.BigEndian.PutUint16(tcph[2:4], 80)
+	binary.BigEndian.PutUint32(tcph[4:8], seq)
+	binary.BigEndian.PutUint32(tcph[8:12], ack)
+	tcph[12] = (tcpHeaderLen / 4) << 4
+	tcph[13] = flags
+	binary.BigEndian.PutUint16(tcph[14:16], 65535)
+	copy(tcph[tcpHeaderLen:], payload)
+	sum := pseudoHeaderChecksum(proto_tcp, pkt[12:16], pkt[16:20], len(tcph))
+	binary.BigEndian.PutUint16(tcph[16:18], ^checksumFold(checksumAdd(sum, tcph)))
+	return pkt
+}
+
+func validTCPChecksum(pkt []byte) bool {
+	src, dst := ipAddrs(ipv4, pkt)
+	tcph := pkt[ipv4HeaderLen:]
+	sum := pseudoHeaderChecksum(proto_tcp, src, dst, len(tcph))
+	return checksumFold(checksumAdd(sum, tcph)) == 0xffff
+}
+
+func newBufs(n, size int) [][]byte {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+	}
+	return bufs
+}
+
+func TestSplitGSO(t *testing.T) {
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	pkt := buildTCPv4(100, tcpACK|tcpPSH, payload)
+	hdr := VirtioNetHdr{
+		Flags:      virtioNetHdrFNeedsCsum,
+		GSOType:    virtioNetHdrGSOTCPv4,
+		HdrLen:     ipv4HeaderLen + tcpHeaderLen,
+		GSOSize:    1400,
+		CsumStart:  ipv4HeaderLen,
+		CsumOffset: tcpChecksumOffset,
+	}
+	frame := make([]byte, VirtioNetHdrLen+len(pkt))
+	hdr.Encode(frame)
+	copy(frame[VirtioNetHdrLen:], pkt)
+
+	bufs := newBufs(4, 1500)
+	n, err := SplitGSO(frame, bufs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("got %d segments, want 3", n)
+	}
+	var got []byte
+	for i, seg := range bufs[:n] {
+		if int(binary.BigEndian.Uint16(seg[2:4])) != len(seg) {
+			t.Errorf("segment %d: wrong IP total length", i)
+		}
+		if checksum(seg[:ipv4HeaderLen]) != 0 {
+			t.Errorf("segment %d: wrong IP checksum", i)
+		}
+		if !validTCPChecksum(seg) {
+			t.Errorf("segment %d: wrong TCP checksum", i)
+		}
+		if seq := binary.BigEndian.Uint32(seg[ipv4HeaderLen+4:]); seq != 100+uint32(1400*i) {
+			t.Errorf("segment %d: wrong sequence number %d", i, seq)
+		}
+		psh := seg[ipv4HeaderLen+13]&tcpPSH != 0
+		if psh != (i == n-1) {
+			t.Errorf("segment %d: PSH should only be set on the last segment", i)
+		}
+		got = append(got, seg[ipv4HeaderLen+tcpHeaderLen:]...)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("payloads are not equal")
+	}
+}
+
+func TestCoalesceTCP(t *testing.T) {
+	payload := make([]byte, 2500)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	pkts := [][]byte{
+		buildTCPv4(0, tcpACK, payload[:1000]),
+		buildTCPv4(1000, tcpACK, payload[1000:2000]),
+		buildTCPv4(2000, tcpACK|tcpPSH, payload[2000:]),
+		// Not contiguous, starts a new super-segment.
+		buildTCPv4(5000, tcpACK, payload[:1000]),
+		buildTCPv4(6000, tcpACK|tcpFIN, nil),
+	}
+
+	var frames [][]byte
+	err := CoalesceTCP(pkts, func(bufs [][]byte) error {
+		frames = append(frames, bytes.Join(bufs, nil))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+
+	var hdr VirtioNetHdr
+	hdr.Decode(frames[0])
+	if hdr.GSOType != virtioNetHdrGSOTCPv4 || hdr.GSOSize != 1000 || hdr.CsumStart != ipv4HeaderLen {
+		t.Errorf("unexpected virtio-net header %+v", hdr)
+	}
+	super := frames[0][VirtioNetHdrLen:]
+	if !bytes.Equal(super[ipv4HeaderLen+tcpHeaderLen:], payload) {
+		t.Error("payloads are not equal")
+	}
+	if super[ipv4HeaderLen+13]&tcpPSH == 0 {
+		t.Error("PSH should be set on the super-segment")
+	}
+
+	// Splitting the super-segment gives back the original segments.
+	bufs := newBufs(4, 1500)
+	n, err := SplitGSO(frames[0], bufs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("got %d segments, want 3", n)
+	}
+	for i := 0; i < n; i++ {
+		seg, orig := bufs[i], pkts[i]
+		// Identification fields may differ.
+		if !bytes.Equal(seg[ipv4HeaderLen:], orig[ipv4HeaderLen:]) {
+			t.Errorf("segment %d differs from the original one", i)
+		}
+	}
+
+	for i, frame := range frames[1:] {
+		hdr.Decode(frame)
+		if hdr.GSOType != virtioNetHdrGSONone {
+			t.Errorf("frame %d should not be a super-segment", i+1)
+		}
+	}
+}
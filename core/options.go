@@ -0,0 +1,241 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/include
+#include "lwip/netif.h"
+
+uint32_t tun2socks_tcp_wnd = 32 * 1024;
+uint8_t tun2socks_tcp_rcv_scale = 0;
+uint32_t tun2socks_tcp_snd_buf = 32 * 1024;
+
+void
+set_mtu(u16_t mtu)
+{
+	(*netif_list).mtu = mtu;
+	(*netif_list).mtu6 = mtu;
+}
+*/
+import "C"
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/acl"
+)
+
+const (
+	// DefaultMTU is the MTU used when none is specified.
+	DefaultMTU = 1500
+
+	// DefaultTCPWindow is the TCP receive window and send buffer size used
+	// when none is specified.
+	DefaultTCPWindow = 32 * 1024
+
+	// Bounds of the MTU, the MSS of TCP connections is also capped by
+	// tcpMaxMSS. The MTU is used for IPv6 too, which requires at least
+	// 1280.
+	minMTU = 1280
+	maxMTU = 65535
+
+	// TCP_MSS in lwipopts.h.
+	tcpMaxMSS = 9000 - 40
+
+	// The largest window allowed with the maximum window scale factor.
+	maxTCPWindow = 0xffff << 14
+
+	// The send queue length derived from the send buffer size in
+	// lwipopts.h must fit in an u16_t.
+	maxTCPSendBuffer = 8 * 1024 * 1024
+)
+
+// StackOptions holds parameters applied when creating a LWIPStack.
+type StackOptions struct {
+	// MTU is the maximum size of IP packets output by the stack, it should
+	// match the MTU of the TUN device. The MSS of TCP connections is
+	// derived from it. It must be at least 1280, the minimum link MTU of
+	// IPv6. Zero means DefaultMTU.
+	MTU int
+
+	// TCPWindow is the receive window of TCP connections in bytes, windows
+	// larger than 64K are advertised with window scaling. It must hold at
+	// least two segments of the MSS derived from MTU. Zero means
+	// DefaultTCPWindow.
+	TCPWindow int
+
+	// TCPSendBuffer is the send buffer size of TCP connections in bytes,
+	// at least two segments like TCPWindow. Zero means the same size as
+	// the receive window.
+	TCPSendBuffer int
+
+	// MaxTCPConns limits the number of concurrent TCP connections, new
+	// connections over the limit are reset. Zero means no limit.
+	MaxTCPConns int
+
+	// MaxTCPConnsPerSource and MaxTCPConnsPerDestination limit the number
+	// of concurrent TCP connections of each client IP and to each
+	// destination IP, like MaxTCPConns.
+	MaxTCPConnsPerSource      int
+	MaxTCPConnsPerDestination int
+
+	// MaxUDPSessions, MaxUDPSessionsPerSource and
+	// MaxUDPSessionsPerDestination limit the number of concurrent UDP
+	// sessions, in total, of each client IP and to the destination IP of
+	// their first datagram. The least recently active session in the way
+	// of a new one is closed to make room for it. Zero means no limit.
+	MaxUDPSessions               int
+	MaxUDPSessionsPerSource      int
+	MaxUDPSessionsPerDestination int
+
+	// DeferTCPHandshake withholds the SYN-ACK of new TCP connections until
+	// the handler's Handle returns, so that clients only see a connection
+	// established once the proxy connection is. If Handle fails, the
+	// client receives an ICMP destination unreachable message if the error
+	// means the destination is unreachable, a RST otherwise.
+	DeferTCPHandshake bool
+
+	// UDPUnreachable makes the stack reply to the first datagram of a UDP
+	// session with an ICMP destination unreachable message if the
+	// handler's Connect fails, so that clients fail fast rather than time
+	// out. The port is reported unreachable, or the host or network if the
+	// error means it is, e.g. syscall.EHOSTUNREACH.
+	UDPUnreachable bool
+
+	// DialTimeout bounds the time handlers implementing
+	// TCPConnContextHandler or UDPConnContextHandler are given to connect,
+	// their context is done once it expires. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// ACL filters new TCP connections and UDP datagrams before handlers
+	// see them, connections are checked before the SYN-ACK is sent. Denied
+	// TCP connections are reset and denied datagrams dropped, rejected
+	// ones are answered with an ICMP administratively prohibited message.
+	// Nil means everything is allowed.
+	ACL *acl.ACL
+
+	// RateLimits are the bandwidth limits of connections, they can be
+	// changed afterwards with SetRateLimits.
+	RateLimits RateLimits
+
+	// InterfaceName is the name of the TUN interface the stack is used
+	// with, it's only passed to handlers in ConnMetadata.
+	InterfaceName string
+}
+
+func (o *StackOptions) mtu() int {
+	if o == nil || o.MTU == 0 {
+		return DefaultMTU
+	}
+	return o.MTU
+}
+
+func (o *StackOptions) tcpWindow() int {
+	if o == nil || o.TCPWindow == 0 {
+		return DefaultTCPWindow
+	}
+	return o.TCPWindow
+}
+
+func (o *StackOptions) tcpSendBuffer() int {
+	if o == nil || o.TCPSendBuffer == 0 {
+		return o.tcpWindow()
+	}
+	return o.TCPSendBuffer
+}
+
+func (o *StackOptions) dialTimeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.DialTimeout
+}
+
+func (o *StackOptions) tcpCaps() connCaps {
+	if o == nil {
+		return connCaps{}
+	}
+	return connCaps{total: o.MaxTCPConns, perSource: o.MaxTCPConnsPerSource, perDest: o.MaxTCPConnsPerDestination}
+}
+
+func (o *StackOptions) udpCaps() connCaps {
+	if o == nil {
+		return connCaps{}
+	}
+	return connCaps{total: o.MaxUDPSessions, perSource: o.MaxUDPSessionsPerSource, perDest: o.MaxUDPSessionsPerDestination}
+}
+
+// tcpMSS returns the largest MSS of TCP connections.
+func (o *StackOptions) tcpMSS() int {
+	if mss := o.mtu() - 40; mss < tcpMaxMSS {
+		return mss
+	}
+	return tcpMaxMSS
+}
+
+func (o *StackOptions) validate() error {
+	if mtu := o.mtu(); mtu < minMTU || mtu > maxMTU {
+		return errors.New("invalid MTU")
+	}
+	if wnd := o.tcpWindow(); wnd < 2*o.tcpMSS() || wnd > maxTCPWindow {
+		return errors.New("invalid TCP window")
+	}
+	if buf := o.tcpSendBuffer(); buf < 2*o.tcpMSS() || buf > maxTCPSendBuffer {
+		return errors.New("invalid TCP send buffer size")
+	}
+	if c := o.tcpCaps(); c.total < 0 || c.perSource < 0 || c.perDest < 0 {
+		return errors.New("invalid maximum number of TCP connections")
+	}
+	if c := o.udpCaps(); c.total < 0 || c.perSource < 0 || c.perDest < 0 {
+		return errors.New("invalid maximum number of UDP sessions")
+	}
+	if o.dialTimeout() < 0 {
+		return errors.New("invalid dial timeout")
+	}
+	if o != nil {
+		if err := o.RateLimits.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply applies options to lwIP, it runs on the loop goroutine. Window and
+// buffer sizes only affect connections accepted afterwards.
+func (o *StackOptions) apply() {
+	setMTU(o.mtu())
+
+	wnd := o.tcpWindow()
+	scale := 0
+	for wnd>>uint(scale) > 0xffff {
+		scale++
+	}
+	C.tun2socks_tcp_wnd = C.uint32_t(wnd)
+	C.tun2socks_tcp_rcv_scale = C.uint8_t(scale)
+	C.tun2socks_tcp_snd_buf = C.uint32_t(o.tcpSendBuffer())
+	tcpCaps = o.tcpCaps()
+	udpCaps = o.udpCaps()
+	deferTCPHandshake = o != nil && o.DeferTCPHandshake
+	if o != nil {
+		accessList = o.ACL
+		SetRateLimits(o.RateLimits)
+	} else {
+		accessList = nil
+		SetRateLimits(RateLimits{})
+	}
+	setTCPSynCallback(deferTCPHandshake || accessList != nil || tcpCaps.set())
+	dialTimeout = o.dialTimeout()
+	if o != nil {
+		interfaceName = o.InterfaceName
+	} else {
+		interfaceName = ""
+	}
+	if o != nil && o.UDPUnreachable {
+		atomic.StoreInt32(&udpUnreachable, 1)
+	} else {
+		atomic.StoreInt32(&udpUnreachable, 0)
+	}
+}
+
+func setMTU(mtu int) {
+	C.set_mtu(C.u16_t(mtu))
+}
@@ -0,0 +1,27 @@
+package core
+
+import "testing"
+
+func TestStackOptionsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		opts  *StackOptions
+		valid bool
+	}{
+		{nil, true},
+		{&StackOptions{MTU: 1280}, true},
+		{&StackOptions{MTU: 1279}, false},
+		{&StackOptions{MTU: 576}, false},
+		{&StackOptions{MTU: 65535}, true},
+		{&StackOptions{MTU: 65536}, false},
+		// Windows and send buffers hold two segments of 1460 bytes.
+		{&StackOptions{TCPWindow: 2920}, true},
+		{&StackOptions{TCPWindow: 2919}, false},
+		{&StackOptions{TCPWindow: 2920, TCPSendBuffer: 2919}, false},
+		{&StackOptions{MTU: 9000, TCPWindow: 2 * 8960}, true},
+		{&StackOptions{MTU: 9000, TCPWindow: 2*8960 - 1, TCPSendBuffer: 2 * 8960}, false},
+	} {
+		if err := tc.opts.validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: validate returned %v", tc.opts, err)
+		}
+	}
+}
@@ -34,9 +34,70 @@ import (
 
 var OutputFn func([]byte) (int, error)
 
+// OutputBatchFn, if set, takes precedence over OutputFn. Packets output by
+// lwIP are then collected and passed to it in batches, allowing the writer
+// to send them with fewer system calls.
+var OutputBatchFn func([][]byte) (int, error)
+
+// RegisterOutputFn registers an output function called with each packet
+// output by lwIP, it replaces a batch output function if one is registered.
 func RegisterOutputFn(fn func([]byte) (int, error)) {
-	OutputFn = fn
-	C.set_output()
+	loop.call(func() {
+		OutputFn = fn
+		OutputBatchFn = nil
+		C.set_output()
+	})
+}
+
+// RegisterOutputBatchFn registers a batch-capable output function, it's
+// called with all packets output by lwIP while the loop goroutine runs a set
+// of queued commands. Packets are only valid during the call.
+func RegisterOutputBatchFn(fn func([][]byte) (int, error)) {
+	loop.call(func() {
+		OutputBatchFn = fn
+		C.set_output()
+	})
+}
+
+// Packets waiting to be flushed to OutputBatchFn, and the pbufs they are
+// referencing, nil for packets copied to buffers from NewBytes. They are
+// only accessed by the loop goroutine.
+var (
+	pendingOutput [][]byte
+	pendingPbufs  []*C.struct_pbuf
+)
+
+// flushOutput passes pending packets to OutputBatchFn, it runs on the loop
+// goroutine.
+func flushOutput() {
+	if len(pendingOutput) == 0 {
+		return
+	}
+	OutputBatchFn(pendingOutput)
+	for i, pkt := range pendingOutput {
+		if p := pendingPbufs[i]; p != nil {
+			C.pbuf_free(p)
+		} else {
+			FreeBytes(pkt[:cap(pkt)])
+		}
+		pendingOutput[i] = nil
+		pendingPbufs[i] = nil
+	}
+	pendingOutput = pendingOutput[:0]
+	pendingPbufs = pendingPbufs[:0]
+}
+
+// outputPacket outputs a packet built by the stack rather than lwIP, e.g. an
+// ICMP message, it runs on the loop goroutine.
+func outputPacket(pkt []byte) {
+	if OutputBatchFn != nil {
+		buf := NewBytes(len(pkt))[:len(pkt)]
+		copy(buf, pkt)
+		pendingOutput = append(pendingOutput, buf)
+		pendingPbufs = append(pendingPbufs, nil)
+	} else {
+		OutputFn(pkt)
+	}
 }
 
 func init() {
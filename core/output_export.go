@@ -15,7 +15,24 @@ func output(p *C.struct_pbuf) C.err_t {
 	// backing Go slice with C array. Buf if there are multiple pbuf structs holding the
 	// data, we must copy data for sending them in one pass.
 	totlen := int(p.tot_len)
-	if p.tot_len == p.len {
+	if OutputBatchFn != nil {
+		if p.tot_len == p.len && p.flags&C.PBUF_FLAG_IS_CUSTOM == 0 {
+			// The pbuf is referenced until the batch is flushed. lwIP
+			// leaves pbufs still referenced by the netif alone, e.g.
+			// TCP segments aren't retransmitted meanwhile. Custom pbufs
+			// may reference packets being input, which are only valid
+			// during the input.
+			C.pbuf_ref(p)
+			buf := (*[1 << 30]byte)(unsafe.Pointer(p.payload))[:totlen:totlen]
+			pendingOutput = append(pendingOutput, buf)
+			pendingPbufs = append(pendingPbufs, p)
+		} else {
+			buf := NewBytes(totlen)[:totlen]
+			C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0)
+			pendingOutput = append(pendingOutput, buf)
+			pendingPbufs = append(pendingPbufs, nil)
+		}
+	} else if p.tot_len == p.len {
 		buf := (*[1 << 30]byte)(unsafe.Pointer(p.payload))[:totlen:totlen]
 		OutputFn(buf[:totlen])
 	} else {
@@ -0,0 +1,288 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimits are bandwidth limits in bytes per second, counting data in
+// both directions. Zero means no limit.
+//
+// TCP connections are slowed down rather than losing data: reading and
+// writing a TCPConn wait for the limits, the receive window of the client
+// only reopens as data is read. UDP datagrams over the limits are dropped.
+type RateLimits struct {
+	// Global limits the traffic of all connections.
+	Global int64
+
+	// PerSource limits the traffic of the connections of each client IP.
+	PerSource int64
+
+	// PerDestination limits the traffic of the connections to each
+	// destination IP. UDP sessions count towards the destination of their
+	// first datagram.
+	PerDestination int64
+
+	// PerConn limits the traffic of each TCP connection or UDP session.
+	PerConn int64
+}
+
+func (l RateLimits) validate() error {
+	if l.Global < 0 || l.PerSource < 0 || l.PerDestination < 0 || l.PerConn < 0 {
+		return errors.New("invalid rate limit")
+	}
+	return nil
+}
+
+func (l RateLimits) limited() bool {
+	return l.Global > 0 || l.PerSource > 0 || l.PerDestination > 0 || l.PerConn > 0
+}
+
+var rateLimits atomic.Value // RateLimits
+
+func init() {
+	rateLimits.Store(RateLimits{})
+}
+
+// SetRateLimits sets the bandwidth limits of TCP connections and UDP
+// sessions, it may be called at any time, existing connections are
+// limited too.
+func SetRateLimits(l RateLimits) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	rateLimits.Store(l)
+	return nil
+}
+
+// CurrentRateLimits returns the limits set by SetRateLimits or
+// StackOptions.RateLimits.
+func CurrentRateLimits() RateLimits {
+	return rateLimits.Load().(RateLimits)
+}
+
+// rateBurst returns the amount of data allowed at once after being idle at
+// rate.
+func rateBurst(rate int64) float64 {
+	if burst := rate / 4; burst > 2*BufSize {
+		return float64(burst)
+	}
+	return 2 * BufSize
+}
+
+// tokenBucket is a token bucket whose rate is passed on each use so that it
+// can change at any time. Tokens may go negative, transfers larger than
+// the burst are allowed and paid for by waiting longer.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned at rate since the last use, the caller must
+// hold mu.
+func (b *tokenBucket) refill(rate int64, now time.Time) {
+	burst := rateBurst(rate)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if now.After(b.last) {
+		// now may be earlier if taken before waiting for mu.
+		if b.tokens += float64(rate) * now.Sub(b.last).Seconds(); b.tokens > burst {
+			b.tokens = burst
+		}
+	} else {
+		return
+	}
+	b.last = now
+}
+
+// take takes n tokens, and returns how long to wait until they're paid for.
+func (b *tokenBucket) take(n int, rate int64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(rate, now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// full reports whether the bucket is full, i.e. as if it was never used.
+func (b *tokenBucket) full(rate int64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(rate, now)
+	return b.tokens >= rateBurst(rate)
+}
+
+// available reports whether tokens are left.
+func (b *tokenBucket) available(rate int64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(rate, now)
+	return b.tokens > 0
+}
+
+// sharedBucket is the bucket of a source or destination, counting the
+// connections using it. It's kept once unused until it's full again, so
+// that closing connections doesn't reset the limits.
+type sharedBucket struct {
+	tokenBucket
+	refs int
+}
+
+type ipKey [net.IPv6len]byte
+
+func keyOf(ip net.IP) ipKey {
+	var k ipKey
+	copy(k[:], ip.To16())
+	return k
+}
+
+// Unused buckets are removed at most once per sweepInterval.
+const sweepInterval = time.Second
+
+var (
+	globalBucket tokenBucket
+
+	bucketsMu     sync.Mutex
+	sourceBuckets = make(map[ipKey]*sharedBucket)
+	destBuckets   = make(map[ipKey]*sharedBucket)
+	lastSweep     time.Time
+)
+
+func acquireBucket(m map[ipKey]*sharedBucket, k ipKey) *sharedBucket {
+	b := m[k]
+	if b == nil {
+		b = &sharedBucket{}
+		m[k] = b
+	}
+	b.refs++
+	return b
+}
+
+func releaseBucket(m map[ipKey]*sharedBucket, k ipKey) {
+	if b := m[k]; b != nil {
+		b.refs--
+	}
+}
+
+// sweepBuckets removes the unused buckets which are full, the caller must
+// hold bucketsMu.
+func sweepBuckets(now time.Time) {
+	if now.Sub(lastSweep) < sweepInterval {
+		return
+	}
+	lastSweep = now
+	limits := CurrentRateLimits()
+	for _, buckets := range []struct {
+		m    map[ipKey]*sharedBucket
+		rate int64
+	}{
+		{sourceBuckets, limits.PerSource},
+		{destBuckets, limits.PerDestination},
+	} {
+		for k, b := range buckets.m {
+			if b.refs == 0 && (buckets.rate <= 0 || b.full(buckets.rate, now)) {
+				delete(buckets.m, k)
+			}
+		}
+	}
+}
+
+// connLimiter applies the rate limits to a connection.
+type connLimiter struct {
+	src, dst     ipKey
+	conn         tokenBucket
+	source, dest *sharedBucket
+}
+
+// newConnLimiter returns the limiter of a connection from src to dst, it
+// must be released once the connection is closed.
+func newConnLimiter(src, dst net.IP) *connLimiter {
+	l := &connLimiter{src: keyOf(src), dst: keyOf(dst)}
+	bucketsMu.Lock()
+	sweepBuckets(time.Now())
+	l.source = acquireBucket(sourceBuckets, l.src)
+	l.dest = acquireBucket(destBuckets, l.dst)
+	bucketsMu.Unlock()
+	return l
+}
+
+func (l *connLimiter) release() {
+	bucketsMu.Lock()
+	releaseBucket(sourceBuckets, l.src)
+	releaseBucket(destBuckets, l.dst)
+	sweepBuckets(time.Now())
+	bucketsMu.Unlock()
+}
+
+// limitedBucket is a bucket with its current rate, zero if unlimited.
+type limitedBucket struct {
+	*tokenBucket
+	rate int64
+}
+
+// buckets returns the buckets of the connection with their rate, and false
+// if there are no limits.
+func (l *connLimiter) buckets() ([4]limitedBucket, bool) {
+	limits := CurrentRateLimits()
+	return [...]limitedBucket{
+		{&globalBucket, limits.Global},
+		{&l.source.tokenBucket, limits.PerSource},
+		{&l.dest.tokenBucket, limits.PerDestination},
+		{&l.conn, limits.PerConn},
+	}, limits.limited()
+}
+
+// wait takes n bytes from the buckets, and waits until they're paid for or
+// done is closed.
+func (l *connLimiter) wait(n int, done <-chan struct{}) {
+	buckets, ok := l.buckets()
+	if !ok {
+		return
+	}
+	now := time.Now()
+	var d time.Duration
+	for _, b := range buckets {
+		if b.rate > 0 {
+			if bd := b.take(n, b.rate, now); bd > d {
+				d = bd
+			}
+		}
+	}
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+	case <-done:
+		t.Stop()
+	}
+}
+
+// allow takes n bytes from the buckets if none is exhausted, it reports
+// whether a datagram of n bytes can be sent.
+func (l *connLimiter) allow(n int) bool {
+	buckets, ok := l.buckets()
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	for _, b := range buckets {
+		if b.rate > 0 && !b.available(b.rate, now) {
+			return false
+		}
+	}
+	for _, b := range buckets {
+		if b.rate > 0 {
+			b.take(n, b.rate, now)
+		}
+	}
+	return true
+}
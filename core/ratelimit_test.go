@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Now()
+	if d := b.take(1000, 4000, now); d != 0 {
+		t.Errorf("waiting %v within the burst", d)
+	}
+	// The burst is 4K, 3K are left.
+	if d := b.take(5096, 4000, now); d != 500*time.Millisecond {
+		t.Errorf("waiting %v, want 500ms", d)
+	}
+	if b.available(4000, now.Add(400*time.Millisecond)) {
+		t.Error("tokens available before the debt is paid")
+	}
+	if !b.available(4000, now.Add(600*time.Millisecond)) {
+		t.Error("no tokens available after the debt is paid")
+	}
+	// Tokens don't exceed the burst, nor go back in time.
+	if d := b.take(4096, 4000, now.Add(time.Hour)); d != 0 {
+		t.Errorf("waiting %v after being idle", d)
+	}
+	if d := b.take(400, 4000, now); d != 100*time.Millisecond {
+		t.Errorf("waiting %v, want 100ms", d)
+	}
+}
+
+// hasBuckets reports whether buckets of the source src and destination dst
+// are left, after sweeping unused ones at now.
+func hasBuckets(src, dst net.IP, now time.Time) bool {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	lastSweep = time.Time{}
+	sweepBuckets(now)
+	return sourceBuckets[keyOf(src)] != nil || destBuckets[keyOf(dst)] != nil
+}
+
+// Reading and writing a connection are slowed down to the rate limits.
+func TestTCPRateLimit(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCPWithOptions(t, h, &StackOptions{RateLimits: RateLimits{PerSource: 16 * 1024}})
+	defer SetRateLimits(RateLimits{})
+	p.connect()
+	conn := <-h.conns
+
+	// 12K at 16K/s with a 4K burst take 500ms.
+	data := bytes.Repeat([]byte{1}, 12*1024)
+	start := time.Now()
+	go func() {
+		for i := 0; i < len(data); i += 1024 {
+			write(s, p.segment(data[i:i+1024]), t)
+		}
+	}()
+	assertEqual(<-readN(conn, len(data)), data, t)
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("read in %v", d)
+	}
+
+	// Both directions count, the burst was used by reading.
+	start = time.Now()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 600*time.Millisecond {
+		t.Errorf("written in %v", d)
+	}
+
+	// Limits are lifted at runtime.
+	SetRateLimits(RateLimits{})
+	start = time.Now()
+	if _, err := conn.Write(data[:4096]); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("written in %v without limits", d)
+	}
+
+	// Buckets are kept until they're full again, unused buckets without
+	// limits are removed.
+	SetRateLimits(RateLimits{PerSource: 16 * 1024})
+	if _, err := conn.Write(data[:4096]); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	src, dst := conn.LocalAddr().(*net.TCPAddr).IP, conn.RemoteAddr().(*net.TCPAddr).IP
+	if !hasBuckets(src, dst, time.Now()) {
+		t.Error("buckets removed once the connection closed")
+	}
+	if hasBuckets(src, dst, time.Now().Add(time.Minute)) {
+		t.Error("buckets left")
+	}
+}
+
+// countingUDPHandler counts received datagrams.
+type countingUDPHandler struct {
+	discardUDPHandler
+	n int32
+}
+
+func (h *countingUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	atomic.AddInt32(&h.n, 1)
+	return nil
+}
+
+// Datagrams over the rate limits are dropped.
+func TestUDPRateLimit(t *testing.T) {
+	s, _ := setupUDP(t)
+	defer s.Close()
+	defer SetRateLimits(RateLimits{})
+	h := &countingUDPHandler{}
+	RegisterUDPConnHandler(h)
+	SetRateLimits(RateLimits{PerConn: 1000})
+
+	// Wait for the session to be connected, early datagrams are queued.
+	write(s, decode(ntpHex), t)
+	for atomic.LoadInt32(&h.n) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 199; i++ {
+		write(s, decode(ntpHex), t)
+	}
+	// The 4K burst lets about 85 datagrams of 48 bytes through.
+	if n := atomic.LoadInt32(&h.n); n < 80 || n > 90 {
+		t.Errorf("%d datagrams received", n)
+	}
+}
+
+// Sessions opened one after another share the limits of their source.
+func TestUDPRateLimitSequential(t *testing.T) {
+	s, _ := setupUDP(t)
+	defer s.Close()
+	defer SetRateLimits(RateLimits{})
+	h := &countingUDPHandler{}
+	RegisterUDPConnHandler(h)
+	SetRateLimits(RateLimits{PerSource: 1000})
+
+	// The first session uses up the burst.
+	write(s, ntpFrom(1), t)
+	for atomic.LoadInt32(&h.n) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 199; i++ {
+		write(s, ntpFrom(1), t)
+	}
+	first := atomic.LoadInt32(&h.n)
+	src := &net.UDPAddr{IP: net.IPv4(100, 106, 65, 0), Port: 1}
+	c, ok := udpConns.Load(udpConnId{src: src.String()})
+	if !ok {
+		t.Fatal("no session")
+	}
+	c.(*udpConn).Close()
+
+	// 1000 bytes/s let about 2 datagrams through in 100ms.
+	for i := 0; i < 100; i++ {
+		write(s, ntpFrom(2), t)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&h.n) - first; n > 5 {
+		t.Errorf("%d datagrams received by the second session", n)
+	}
+}
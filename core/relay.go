@@ -0,0 +1,106 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// DuplexConn is a connection whose reading and writing sides can be closed
+// separately, e.g. TCPConn or *net.TCPConn.
+type DuplexConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// Relay copies data between lhs and rhs in both directions until both
+// directions are done, then closes both connections. It's meant to be used
+// by TCP handlers relaying a connection comming from TUN (lhs) to a proxy
+// connection (rhs).
+//
+// Once a side is read to EOF, the EOF is passed on by closing the writing
+// side of the other connection, the opposite direction keeps going, i.e. the
+// connection is half-closed. If the other connection can't be half-closed,
+// both connections are closed. If copying fails in a direction, both
+// connections are closed and the error is returned. If the failure is a
+// reset, the connections are reset rather than closed, e.g. a TCPConn is
+// aborted when the proxy connection is reset, so that clients see a RST as
+// they would without the tunnel.
+//
+// It returns the number of bytes copied from lhs to rhs and from rhs to lhs,
+// and the first error, if any.
+func Relay(lhs, rhs net.Conn) (up, down int64, err error) {
+	var closeOnce sync.Once
+	closeBoth := func(e error) {
+		closeOnce.Do(func() {
+			err = e
+			if isReset(e) {
+				resetConn(lhs)
+				resetConn(rhs)
+			} else {
+				lhs.Close()
+				rhs.Close()
+			}
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var e error
+		up, e = relayHalf(rhs, lhs, closeBoth)
+		if e != nil {
+			closeBoth(e)
+		}
+	}()
+	down, e := relayHalf(lhs, rhs, closeBoth)
+	if e != nil {
+		closeBoth(e)
+	}
+	wg.Wait()
+
+	closeBoth(nil)
+	return up, down, err
+}
+
+// relayHalf copies from src to dst with a pooled buffer, and passes EOF on.
+func relayHalf(dst, src net.Conn, closeBoth func(error)) (int64, error) {
+	buf := NewBytes(BufSize)
+	n, err := io.CopyBuffer(dst, src, buf)
+	FreeBytes(buf)
+	if err != nil {
+		return n, err
+	}
+
+	if d, ok := dst.(DuplexConn); ok {
+		d.CloseWrite()
+		if s, ok := src.(DuplexConn); ok {
+			s.CloseRead()
+		}
+	} else {
+		closeBoth(nil)
+	}
+	return n, nil
+}
+
+// isReset reports whether err means the connection was reset.
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, errnoConnReset)
+}
+
+// resetConn closes c with a RST segment if possible.
+func resetConn(c net.Conn) {
+	switch rc := c.(type) {
+	case interface{ Abort() }:
+		rc.Abort()
+	case interface{ SetLinger(int) error }:
+		rc.SetLinger(0)
+		c.Close()
+	default:
+		c.Close()
+	}
+}
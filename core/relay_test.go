@@ -0,0 +1,145 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+type relayResult struct {
+	up, down int64
+	err      error
+}
+
+func relay(lhs, rhs net.Conn) <-chan relayResult {
+	ch := make(chan relayResult, 1)
+	go func() {
+		var r relayResult
+		r.up, r.down, r.err = Relay(lhs, rhs)
+		ch <- r
+	}()
+	return ch
+}
+
+// The server gets EOF after the request and can still send the response.
+func TestRelayHalfClose(t *testing.T) {
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	done := relay(lhs, rhs)
+
+	request, response := []byte("request"), []byte("response")
+	if _, err := client.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	client.CloseWrite()
+	b, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(b, request, t)
+
+	if _, err := server.Write(response); err != nil {
+		t.Fatal(err)
+	}
+	server.CloseWrite()
+	b, err = ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(b, response, t)
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.up != int64(len(request)) || r.down != int64(len(response)) {
+		t.Errorf("relayed %d bytes up and %d bytes down, want %d and %d", r.up, r.down, len(request), len(response))
+	}
+}
+
+type failingConn struct {
+	net.Conn
+	err error
+}
+
+func (c failingConn) Read(b []byte) (int, error) {
+	return 0, c.err
+}
+
+// An error in a direction closes both connections and is returned.
+func TestRelayError(t *testing.T) {
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	readErr := errors.New("read failed")
+	done := relay(failingConn{lhs, readErr}, rhs)
+
+	// Neither side is left open.
+	if _, err := ioutil.ReadAll(server); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-done; !errors.Is(r.err, readErr) {
+		t.Fatalf("got error %v, want %v", r.err, readErr)
+	}
+}
+
+// A reset of the proxy connection resets the connection comming from TUN.
+func TestRelayReset(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	p.connect()
+	rhs, server := tcpPair(t)
+	done := relay(<-h.conns, rhs)
+
+	server.SetLinger(0)
+	server.Close()
+	p.waitRST()
+	if r := <-done; !isReset(r.err) {
+		t.Fatalf("got error %v, want a reset error", r.err)
+	}
+}
+
+// A reset of the connection comming from TUN resets the proxy connection.
+func TestRelayPeerReset(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	p.connect()
+	rhs, server := tcpPair(t)
+	defer server.Close()
+	done := relay(<-h.conns, rhs)
+
+	write(s, buildTCPv4Ack(p.seq, p.ack, tcpRST|tcpACK, nil), t)
+	if _, err := ioutil.ReadAll(server); !isReset(err) {
+		t.Fatalf("got error %v, want a reset error", err)
+	}
+	if r := <-done; !isReset(r.err) {
+		t.Fatalf("got error %v, want a reset error", r.err)
+	}
+}
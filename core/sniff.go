@@ -0,0 +1,135 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// sniffHostname returns the hostname the client connects to according to
+// the first data it sent, the server name of a TLS ClientHello or the Host
+// header of an HTTP request. It returns an empty string if data is neither,
+// or is truncated.
+func sniffHostname(data []byte) string {
+	if len(data) > 0 && data[0] == tlsHandshake {
+		return sniffTLS(data)
+	}
+	return sniffHTTP(data)
+}
+
+const (
+	tlsHandshake       = 22
+	tlsClientHello     = 1
+	tlsExtServerName   = 0
+	tlsServerNameHost  = 0
+	tlsRecordHeaderLen = 5
+)
+
+// tlsReader reads the fields of a TLS message, a read past the end of the
+// message leaves it failed.
+type tlsReader struct {
+	b      []byte
+	failed bool
+}
+
+func (r *tlsReader) next(n int) []byte {
+	if r.failed || n > len(r.b) {
+		r.failed = true
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *tlsReader) uint8() int {
+	if b := r.next(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *tlsReader) uint16() int {
+	if b := r.next(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// vector returns the content of a vector with a length of lenBytes bytes.
+func (r *tlsReader) vector(lenBytes int) *tlsReader {
+	n := r.uint8()
+	if lenBytes == 2 {
+		n = n<<8 | r.uint8()
+	}
+	return &tlsReader{b: r.next(n), failed: r.failed}
+}
+
+func sniffTLS(data []byte) string {
+	r := &tlsReader{b: data}
+	r.next(tlsRecordHeaderLen)
+	if r.uint8() != tlsClientHello {
+		return ""
+	}
+	r.next(3)   // Handshake length.
+	r.next(2)   // Version.
+	r.next(32)  // Random.
+	r.vector(1) // Session ID.
+	r.vector(2) // Cipher suites.
+	r.vector(1) // Compression methods.
+	exts := r.vector(2)
+	for !exts.failed && len(exts.b) > 0 {
+		typ := exts.uint16()
+		ext := exts.vector(2)
+		if typ != tlsExtServerName {
+			continue
+		}
+		names := ext.vector(2)
+		for !names.failed && len(names.b) > 0 {
+			nameType := names.uint8()
+			name := names.vector(2)
+			if nameType == tlsServerNameHost && !name.failed {
+				return strings.ToLower(string(name.b))
+			}
+		}
+	}
+	return ""
+}
+
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+func sniffHTTP(data []byte) string {
+	isHTTP := false
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(data, []byte(m)) {
+			isHTTP = true
+			break
+		}
+	}
+	if !isHTTP {
+		return ""
+	}
+
+	lines := bytes.Split(data, []byte("\r\n"))
+	if len(lines) < 2 {
+		return ""
+	}
+	// The request line is skipped, and the last line may be truncated.
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) == 0 {
+			// End of the headers.
+			break
+		}
+		i := bytes.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(string(line[:i]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(line[i+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(strings.Trim(host, "[]"))
+	}
+	return ""
+}
@@ -11,6 +11,13 @@ set_tcp_accept_callback(struct tcp_pcb *pcb) {
 	tcp_accept(pcb, tcpAcceptFn);
 }
 
+extern int tcpSynFn(struct tcp_pcb *newpcb);
+
+void
+set_tcp_syn_callback(int enable) {
+	tun2socks_tcp_syn = enable ? tcpSynFn : NULL;
+}
+
 extern err_t tcpRecvFn(void *arg, struct tcp_pcb *tpcb, struct pbuf *p, err_t err);
 
 void
@@ -45,6 +52,16 @@ func setTCPAcceptCallback(pcb *C.struct_tcp_pcb) {
 	C.set_tcp_accept_callback(pcb)
 }
 
+// setTCPSynCallback sets whether new connections are passed to tcpSynFn,
+// before the SYN-ACK is sent.
+func setTCPSynCallback(enable bool) {
+	if enable {
+		C.set_tcp_syn_callback(1)
+	} else {
+		C.set_tcp_syn_callback(0)
+	}
+}
+
 func setTCPRecvCallback(pcb *C.struct_tcp_pcb) {
 	C.set_tcp_recv_callback(pcb)
 }
@@ -8,6 +8,9 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
 	"unsafe"
 )
 
@@ -23,11 +26,18 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 		return err
 	}
 
-	if tcpConnHandler == nil {
-		panic("must register a TCP connection handler")
+	if arg != nil {
+		// The handshake of a connection created by tcpSynFn completed,
+		// the handler already accepted it.
+		return C.ERR_OK
 	}
 
-	if _, nerr := newTCPConn(newpcb, tcpConnHandler); nerr != nil {
+	if refuseTCPConn(newpcb) {
+		C.tcp_abort(newpcb)
+		return C.ERR_ABRT
+	}
+
+	if _, nerr := newTCPConn(newpcb, tcpConnHandler, false); nerr != nil {
 		switch nerr.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
 			return C.ERR_ABRT
@@ -41,6 +51,50 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 	return C.ERR_OK
 }
 
+// tcpSynFn is called for new connections before the SYN-ACK is sent if
+// handshakes are deferred, an ACL or limits on concurrent connections are
+// set. Refused connections are freed, if handshakes are deferred the
+// SYN-ACK of the others is withheld until the handler accepts them. It
+// returns 0 if the handshake goes on as usual.
+//
+//export tcpSynFn
+func tcpSynFn(newpcb *C.struct_tcp_pcb) C.int {
+	if tcpACLRefused(newpcb) {
+		return 1
+	}
+	if refuseTCPConn(newpcb) {
+		C.tcp_abort(newpcb)
+		return 1
+	}
+	if !deferTCPHandshake {
+		return 0
+	}
+	newTCPConn(newpcb, tcpConnHandler, true)
+	return 1
+}
+
+// refuseTCPConn reports whether a new connection must be reset.
+func refuseTCPConn(pcb *C.struct_tcp_pcb) bool {
+	if tcpConnHandler == nil {
+		panic("must register a TCP connection handler")
+	}
+
+	if refuseConns {
+		// The stack is being closed.
+		return true
+	}
+
+	if tcpCaps.set() {
+		ips := newIPPair(net.ParseIP(ipAddrNTOA(pcb.remote_ip)), net.ParseIP(ipAddrNTOA(pcb.local_ip)))
+		if overTCPCaps(ips) {
+			// Too many connections, reset the new one.
+			atomic.AddInt64(&overloadStats.TCPRefused, 1)
+			return true
+		}
+	}
+	return false
+}
+
 //export tcpRecvFn
 func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err C.err_t) C.err_t {
 	if err != C.ERR_OK && err != C.ERR_ABRT {
@@ -76,17 +130,19 @@ func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, err
 		}
 	}
 
-	var buf []byte
-	var totlen = int(p.tot_len)
-	if p.tot_len == p.len {
-		buf = (*[1 << 30]byte)(unsafe.Pointer(p.payload))[:totlen:totlen]
-	} else {
-		buf = NewBytes(totlen)
-		defer FreeBytes(buf)
-		C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0)
+	// Pass the payload of each pbuf in the chain as is, Receive copies it
+	// only once. The window is updated as the data is read by the handler.
+	var rerr error
+	for q := p; q != nil; q = q.next {
+		if q.len == 0 {
+			continue
+		}
+		buf := (*[1 << 30]byte)(unsafe.Pointer(q.payload))[:q.len:q.len]
+		rerr = conn.(TCPConn).Receive(buf)
+		if rerr != nil && rerr.(*lwipError).Code != LWIP_ERR_OK {
+			break
+		}
 	}
-
-	rerr := conn.(TCPConn).Receive(buf[:totlen])
 	if rerr != nil {
 		switch rerr.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
@@ -139,7 +195,7 @@ func tcpErrFn(arg unsafe.Pointer, err C.err_t) {
 			conn.(TCPConn).Err(errors.New("connection aborted"))
 		case C.ERR_RST:
 			// The connection was reset by the remote host
-			conn.(TCPConn).Err(errors.New("connection reseted"))
+			conn.(TCPConn).Err(syscall.ECONNRESET)
 		default:
 			conn.(TCPConn).Err(errors.New(fmt.Sprintf("lwip error code %v", int(err))))
 		}
@@ -3,15 +3,18 @@ package core
 /*
 #cgo CFLAGS: -I./c/include
 #include "lwip/tcp.h"
+#include "lwip/priv/tcp_priv.h"
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -58,21 +61,51 @@ const (
 type tcpConn struct {
 	sync.Mutex
 
-	pcb           *C.struct_tcp_pcb
-	handler       TCPConnHandler
-	remoteAddr    *net.TCPAddr
-	localAddr     *net.TCPAddr
-	connKeyArg    unsafe.Pointer
-	connKey       uint32
-	canWrite      *sync.Cond // Condition variable to implement TCP backpressure.
-	state         tcpConnState
-	sndPipeReader *io.PipeReader
-	sndPipeWriter *io.PipeWriter
-	closeOnce     sync.Once
-	closeErr      error
-}
-
-func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error) {
+	pcb        *C.struct_tcp_pcb
+	handler    TCPConnHandler
+	remoteAddr *net.TCPAddr
+	localAddr  *net.TCPAddr
+	connKeyArg unsafe.Pointer
+	connKey    uint32
+	writeMu    sync.Mutex    // Serializes writers.
+	canWrite   chan struct{} // Signaled when the writer may try again, to implement TCP backpressure.
+	state      tcpConnState
+	err        error // The error the connection failed with in tcpErrored state.
+	closeOnce  sync.Once
+	closeErr   error
+	cancel     context.CancelFunc // Cancels the context of the handler.
+	meta       *ConnMetadata
+	sniffed    bool // The first data was sniffed, only accessed by the loop goroutine.
+	limiter    *connLimiter
+	ips        ipPair
+	done       chan struct{} // Closed once the connection is released.
+
+	// The SYN-ACK is withheld until Handle returns, only accessed by the
+	// loop goroutine.
+	synPending bool
+
+	// Received data is copied into pooled buffers queued in rcvQueue,
+	// the lwIP thread never waits for the reader. The queue is bounded by
+	// the receive window, as tcp_recved() is only called once data has
+	// been consumed by the reader and lwIP trims data beyond the window.
+	rcvMu      sync.Mutex
+	rcvCond    *sync.Cond
+	rcvQueue   [][]byte
+	rcvClosed  bool // No more data will be queued.
+	readClosed bool // The reading side is closed, queued data is dropped.
+	rcvRead    int  // Bytes consumed but not yet passed to tcp_recved().
+	rcvWnd     int
+
+	// The buffer being consumed by the reader, guarded by readMu.
+	readMu  sync.Mutex
+	readBuf []byte
+	readPos int
+}
+
+// newTCPConn creates a connection for pcb and passes it to handler. If
+// deferred is true, pcb is in SYN_RCVD state and the SYN-ACK is only sent
+// once the handler accepted the connection.
+func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler, deferred bool) (TCPConn, error) {
 	connKeyArg := newConnKeyArg()
 	connKey := rand.Uint32()
 	setConnKeyVal(unsafe.Pointer(connKeyArg), connKey)
@@ -86,22 +119,30 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	setTCPErrCallback(pcb)
 	setTCPPollCallback(pcb, C.u8_t(TCP_POLL_INTERVAL))
 
-	pipeReader, pipeWriter := io.Pipe()
 	conn := &tcpConn{
-		pcb:           pcb,
-		handler:       handler,
-		localAddr:     ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)),
-		remoteAddr:    ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port)),
-		connKeyArg:    connKeyArg,
-		connKey:       connKey,
-		canWrite:      sync.NewCond(&sync.Mutex{}),
-		state:         tcpNewConn,
-		sndPipeReader: pipeReader,
-		sndPipeWriter: pipeWriter,
+		pcb:        pcb,
+		handler:    handler,
+		localAddr:  ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)),
+		remoteAddr: ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port)),
+		connKeyArg: connKeyArg,
+		connKey:    connKey,
+		canWrite:   make(chan struct{}, 1),
+		state:      tcpNewConn,
+		rcvWnd:     int(C.tun2socks_tcp_wnd),
+		synPending: deferred,
+		done:       make(chan struct{}),
 	}
+	conn.rcvCond = sync.NewCond(&conn.rcvMu)
+	conn.meta = newConnMetadata(conn.localAddr, conn.remoteAddr, conn.remoteAddr.IP)
+	conn.limiter = newConnLimiter(conn.localAddr.IP, conn.remoteAddr.IP)
+	conn.ips = newIPPair(conn.localAddr.IP, conn.remoteAddr.IP)
+	ctx, cancel := handlerContext()
+	conn.cancel = cancel
 
 	// Associate conn with key and save to the global map.
 	tcpConns.Store(connKey, conn)
+	atomic.AddInt32(&tcpConnCount, 1)
+	tcpIPCounts.add(conn.ips)
 
 	// Connecting remote host could take some time, do it in another goroutine
 	// to prevent blocking the lwip thread.
@@ -109,29 +150,88 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	conn.state = tcpConnecting
 	conn.Unlock()
 	go func() {
-		err := handler.Handle(TCPConn(conn), conn.remoteAddr)
+		err := HandleTCP(ctx, handler, TCPConn(conn), conn.remoteAddr)
+		cancel()
 		if err != nil {
-			conn.Abort()
+			if reason, ok := unreachError(err); ok && deferred {
+				conn.unreachable(reason)
+			} else {
+				conn.Abort()
+			}
 		} else {
 			conn.Lock()
-			if conn.state != tcpConnecting {
+			switch conn.state {
+			case tcpConnecting:
+				conn.state = tcpConnected
+			case tcpWriteClosed:
+				// Closed while connecting, e.g. by closing the stack.
+			default:
 				conn.Unlock()
 				return
 			}
-			conn.state = tcpConnected
 			conn.Unlock()
 
-			lwipMutex.Lock()
-			if pcb.refused_data != nil {
-				C.tcp_process_refused_data(pcb)
-			}
-			lwipMutex.Unlock()
+			loop.post(func() {
+				if conn.pcbFreed() {
+					return
+				}
+				if conn.synPending {
+					conn.acceptSYN()
+				} else if pcb.refused_data != nil {
+					C.tcp_process_refused_data(pcb)
+				}
+			})
 		}
 	}()
 
 	return conn, NewLWIPError(LWIP_ERR_OK)
 }
 
+// acceptSYN sends the withheld SYN-ACK, with a FIN if the writing side was
+// closed meanwhile. It runs on the loop goroutine.
+func (conn *tcpConn) acceptSYN() {
+	conn.synPending = false
+	if C.tcp_syn_ack(conn.pcb) != C.ERR_OK {
+		conn.Lock()
+		conn.abortInternal()
+		conn.Unlock()
+		return
+	}
+	conn.Lock()
+	writeClosed := conn.state == tcpWriteClosed
+	conn.Unlock()
+	if writeClosed {
+		C.tcp_shutdown(conn.pcb, 0, 1)
+	}
+	// Writes wait for the SYN-ACK.
+	conn.signalWrite()
+}
+
+// unreachable frees a connection whose SYN-ACK was withheld without
+// resetting it, and sends an ICMP destination unreachable message to the
+// client instead.
+func (conn *tcpConn) unreachable(reason unreachReason) {
+	loop.call(func() {
+		conn.Lock()
+		defer conn.Unlock()
+		if conn.state >= tcpAborting {
+			return
+		}
+		iss := uint32(conn.pcb.rcv_nxt) - 1
+		C.tcp_arg(conn.pcb, nil)
+		C.tcp_err(conn.pcb, nil)
+		conn.release()
+		C.tcp_abandon(conn.pcb, 0)
+		if pkt, err := buildICMPUnreachable(reason, buildTCPSYN(conn.localAddr, conn.remoteAddr, iss)); err == nil {
+			outputPacket(pkt)
+		}
+	})
+}
+
+func (conn *tcpConn) Metadata() *ConnMetadata {
+	return conn.meta
+}
+
 func (conn *tcpConn) RemoteAddr() net.Addr {
 	return conn.remoteAddr
 }
@@ -177,45 +277,175 @@ func (conn *tcpConn) receiveCheck() error {
 	default:
 		panic("unexpected error")
 	}
-	return nil
 }
 
+// Receive queues data for the reader, it never blocks.
 func (conn *tcpConn) Receive(data []byte) error {
+	// The first data is sniffed even if it's refused while the handler
+	// runs, so that the handler can see the hostname. lwIP delivers it
+	// again later.
+	if !conn.sniffed {
+		conn.sniffed = true
+		if hostname := sniffHostname(data); hostname != "" {
+			conn.meta.setHostname(hostname)
+		}
+	}
 	if err := conn.receiveCheck(); err != nil {
 		return err
 	}
-	n, err := conn.sndPipeWriter.Write(data)
-	if err != nil {
+
+	conn.rcvMu.Lock()
+	defer conn.rcvMu.Unlock()
+
+	if conn.readClosed {
 		return NewLWIPError(LWIP_ERR_CLSD)
 	}
-	C.tcp_recved(conn.pcb, C.u16_t(n))
+	for len(data) > 0 {
+		// Fill up the last buffer before taking a new one.
+		var buf []byte
+		if last := len(conn.rcvQueue) - 1; last >= 0 && len(conn.rcvQueue[last]) < cap(conn.rcvQueue[last]) {
+			buf = conn.rcvQueue[last]
+			conn.rcvQueue = conn.rcvQueue[:last]
+		} else {
+			buf = NewBytes(BufSize)[:0]
+		}
+		n := copy(buf[len(buf):cap(buf)], data)
+		conn.rcvQueue = append(conn.rcvQueue, buf[:len(buf)+n])
+		data = data[n:]
+	}
+	conn.rcvCond.Signal()
 	return NewLWIPError(LWIP_ERR_OK)
 }
 
-func (conn *tcpConn) Read(data []byte) (int, error) {
+// nextReadBuf makes sure there is data to consume in readBuf, waiting for
+// the lwIP thread if necessary. The caller must hold readMu.
+func (conn *tcpConn) nextReadBuf() error {
+	if conn.readPos < len(conn.readBuf) {
+		return nil
+	}
+	if conn.readBuf != nil {
+		n := len(conn.readBuf)
+		FreeBytes(conn.readBuf[:cap(conn.readBuf)])
+		conn.readBuf = nil
+		conn.consumed(n)
+	}
+
+	conn.rcvMu.Lock()
+	for len(conn.rcvQueue) == 0 && !conn.rcvClosed && !conn.readClosed {
+		conn.rcvCond.Wait()
+	}
+	if conn.readClosed {
+		conn.rcvMu.Unlock()
+		return io.EOF
+	}
+	if len(conn.rcvQueue) > 0 {
+		conn.readBuf = conn.rcvQueue[0]
+		conn.readPos = 0
+		conn.rcvQueue[0] = nil
+		conn.rcvQueue = conn.rcvQueue[1:]
+		conn.rcvMu.Unlock()
+		return nil
+	}
+	conn.rcvMu.Unlock()
+
 	conn.Lock()
-	if conn.state == tcpReceiveClosed {
-		conn.Unlock()
-		return 0, io.EOF
+	defer conn.Unlock()
+	if conn.state == tcpErrored {
+		return conn.opError("read")
 	}
 	if conn.state >= tcpClosing {
-		conn.Unlock()
-		return 0, io.ErrClosedPipe
+		return io.ErrClosedPipe
 	}
-	conn.Unlock()
-
 	// Handler should get EOF.
-	n, err := conn.sndPipeReader.Read(data)
-	if err == io.ErrClosedPipe {
-		err = io.EOF
+	return io.EOF
+}
+
+// consumed accounts for n bytes consumed by the reader, the receive window
+// is updated once enough data has been consumed or the queue is empty.
+func (conn *tcpConn) consumed(n int) {
+	conn.rcvMu.Lock()
+	conn.rcvRead += n
+	update := conn.rcvRead >= conn.rcvWnd/4 || len(conn.rcvQueue) == 0
+	conn.rcvMu.Unlock()
+	if update {
+		conn.updateRcvWnd()
+	}
+}
+
+// updateRcvWnd passes consumed bytes to tcp_recved(), and processes data
+// lwIP may have kept. The reader doesn't wait for it.
+func (conn *tcpConn) updateRcvWnd() {
+	loop.post(conn.updateRcvWndInternal)
+}
+
+func (conn *tcpConn) updateRcvWndInternal() {
+	conn.rcvMu.Lock()
+	n := conn.rcvRead
+	conn.rcvRead = 0
+	conn.rcvMu.Unlock()
+
+	if conn.pcbFreed() {
+		return
+	}
+	for n > 0 {
+		l := n
+		if l > 0xffff {
+			l = 0xffff
+		}
+		C.tcp_recved(conn.pcb, C.u16_t(l))
+		n -= l
+	}
+	if conn.pcb.refused_data != nil {
+		C.tcp_process_refused_data(conn.pcb)
+	}
+}
+
+func (conn *tcpConn) Read(data []byte) (int, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+
+	if err := conn.nextReadBuf(); err != nil {
+		return 0, err
+	}
+	n := len(conn.readBuf) - conn.readPos
+	if n > len(data) {
+		n = len(data)
+	}
+	// Waiting for rate limits delays the window update.
+	conn.limiter.wait(n, conn.done)
+	n = copy(data, conn.readBuf[conn.readPos:])
+	conn.readPos += n
+	return n, nil
+}
+
+// WriteTo writes received data to w until EOF or an error occurs, it
+// implements io.WriterTo so that io.Copy passes the pooled buffers holding
+// the data to w, avoiding a copy.
+func (conn *tcpConn) WriteTo(w io.Writer) (int64, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+
+	var written int64
+	for {
+		if err := conn.nextReadBuf(); err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+		conn.limiter.wait(len(conn.readBuf)-conn.readPos, conn.done)
+		n, err := w.Write(conn.readBuf[conn.readPos:])
+		written += int64(n)
+		conn.readPos += n
+		if err != nil {
+			return written, err
+		}
 	}
-	return n, err
 }
 
 // writeInternal enqueues data to snd_buf, and treats ERR_MEM returned by tcp_write not an error,
 // but instead tells the caller that data is not successfully enqueued, and should try
-// again another time. By calling this function, the lwIP thread is assumed to be already
-// locked by the caller.
+// again another time. This function must be called on the loop goroutine.
 func (conn *tcpConn) writeInternal(data []byte) (int, error) {
 	err := C.tcp_write(conn.pcb, unsafe.Pointer(&data[0]), C.u16_t(len(data)), C.TCP_WRITE_FLAG_COPY)
 	if err == C.ERR_OK {
@@ -244,47 +474,100 @@ func (conn *tcpConn) writeCheck() error {
 		fallthrough
 	case tcpClosed:
 		fallthrough
-	case tcpErrored:
-		fallthrough
 	case tcpAborting:
 		return io.ErrClosedPipe
+	case tcpErrored:
+		return conn.opError("write")
 	default:
 		panic("unexpected error")
 	}
-	return nil
+}
+
+// opError wraps the error the connection failed with, like errors returned
+// by net.TCPConn, e.g. a reset is reported with syscall.ECONNRESET. The caller
+// must hold the lock.
+func (conn *tcpConn) opError(op string) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: conn.localAddr, Addr: conn.remoteAddr, Err: conn.err}
 }
 
 func (conn *tcpConn) Write(data []byte) (int, error) {
-	totalWritten := 0
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
 
-	conn.canWrite.L.Lock()
-	defer conn.canWrite.L.Unlock()
+	if _, limited := conn.limiter.buckets(); !limited {
+		return conn.write(data)
+	}
+	// Data is written in small chunks waiting for rate limits, so that it's
+	// sent at an even rate.
+	totalWritten := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > BufSize {
+			n = BufSize
+		}
+		conn.limiter.wait(n, conn.done)
+		written, err := conn.write(data[:n])
+		totalWritten += written
+		if err != nil {
+			return totalWritten, err
+		}
+		data = data[n:]
+	}
+	return totalWritten, nil
+}
 
+// write writes data to lwIP, waiting for room in the send buffer. The
+// caller must hold writeMu.
+func (conn *tcpConn) write(data []byte) (int, error) {
+	totalWritten := 0
 	for len(data) > 0 {
 		if err := conn.writeCheck(); err != nil {
 			return totalWritten, err
 		}
 
-		lwipMutex.Lock()
-		toWrite := len(data)
-		if toWrite > int(conn.pcb.snd_buf) {
-			// Write at most the size of the LWIP buffer.
-			toWrite = int(conn.pcb.snd_buf)
-		}
-		if toWrite > 0 {
-			written, err := conn.writeInternal(data[0:toWrite])
-			totalWritten += written
-			if err != nil {
-				lwipMutex.Unlock()
-				return totalWritten, err
+		var written int
+		var err error
+		loop.call(func() {
+			if conn.pcbFreed() {
+				// The pcb was freed since writeCheck().
+				err = conn.writeCheck()
+				return
+			}
+			if conn.synPending {
+				// Wait for the SYN-ACK to be sent.
+				return
 			}
-			data = data[written:len(data)]
+			for written < len(data) {
+				toWrite := len(data) - written
+				if toWrite > int(conn.pcb.snd_buf) {
+					// Write at most the size of the LWIP buffer.
+					toWrite = int(conn.pcb.snd_buf)
+				}
+				if toWrite > 0xffff {
+					// The length passed to tcp_write() is 16 bits, a
+					// larger send buffer is filled in several calls.
+					toWrite = 0xffff
+				}
+				if toWrite == 0 {
+					break
+				}
+				var n int
+				n, err = conn.writeInternal(data[written : written+toWrite])
+				written += n
+				if n == 0 || err != nil {
+					break
+				}
+			}
+		})
+		totalWritten += written
+		if err != nil {
+			return totalWritten, err
 		}
-		lwipMutex.Unlock()
+		data = data[written:len(data)]
 		if len(data) == 0 {
 			break // Don't block if all the data has been written.
 		}
-		conn.canWrite.Wait()
+		<-conn.canWrite
 	}
 
 	return totalWritten, nil
@@ -303,16 +586,38 @@ func (conn *tcpConn) CloseWrite() error {
 	}
 	conn.Unlock()
 
-	lwipMutex.Lock()
-	// FIXME Handle tcp_shutdown error.
-	C.tcp_shutdown(conn.pcb, 0, 1)
-	lwipMutex.Unlock()
+	loop.call(func() {
+		if conn.pcbFreed() || conn.synPending {
+			// The FIN is sent with the SYN-ACK.
+			return
+		}
+		// FIXME Handle tcp_shutdown error.
+		C.tcp_shutdown(conn.pcb, 0, 1)
+	})
 
 	return nil
 }
 
 func (conn *tcpConn) CloseRead() error {
-	return conn.sndPipeReader.Close()
+	conn.rcvMu.Lock()
+	if conn.readClosed {
+		conn.rcvMu.Unlock()
+		return nil
+	}
+	conn.readClosed = true
+	for i, buf := range conn.rcvQueue {
+		conn.rcvRead += len(buf)
+		FreeBytes(buf[:cap(buf)])
+		conn.rcvQueue[i] = nil
+	}
+	conn.rcvQueue = nil
+	conn.rcvCond.Broadcast()
+	conn.rcvMu.Unlock()
+
+	// Open the window for the dropped data, further data will be refused
+	// and the receiving side of the connection shut down.
+	conn.updateRcvWnd()
+	return nil
 }
 
 func (conn *tcpConn) Sent(len uint16) error {
@@ -349,6 +654,15 @@ func (conn *tcpConn) isClosed() bool {
 	return conn.state == tcpClosed
 }
 
+// pcbFreed reports whether the pcb was freed, after the connection was
+// closed or an error occured.
+func (conn *tcpConn) pcbFreed() bool {
+	conn.Lock()
+	defer conn.Unlock()
+
+	return conn.state >= tcpClosed
+}
+
 func (conn *tcpConn) checkState() error {
 	if conn.isClosed() {
 		return nil
@@ -365,11 +679,20 @@ func (conn *tcpConn) checkState() error {
 	}
 
 	// Signal the writer to try writting.
-	conn.canWrite.Broadcast()
+	conn.signalWrite()
 
 	return NewLWIPError(LWIP_ERR_OK)
 }
 
+// signalWrite wakes up the writer, the signal is kept until the writer
+// waits so that it can't be missed.
+func (conn *tcpConn) signalWrite() {
+	select {
+	case conn.canWrite <- struct{}{}:
+	default:
+	}
+}
+
 func (conn *tcpConn) Close() error {
 	conn.closeOnce.Do(conn.close)
 	return conn.closeErr
@@ -394,15 +717,15 @@ func (conn *tcpConn) setLocalClosed() error {
 		return nil
 	}
 
-	// Causes the read half of the pipe returns.
-	conn.sndPipeWriter.Close()
+	// Causes the reader to get EOF once queued data is read.
+	conn.closeRcvQueue()
 
 	if conn.state == tcpWriteClosed {
 		conn.state = tcpClosing
 	} else {
 		conn.state = tcpReceiveClosed
 	}
-	conn.canWrite.Broadcast()
+	conn.signalWrite()
 	return nil
 }
 
@@ -440,9 +763,9 @@ func (conn *tcpConn) Abort() {
 	}
 	conn.Unlock()
 
-	lwipMutex.Lock()
-	conn.checkState()
-	lwipMutex.Unlock()
+	loop.call(func() {
+		conn.checkState()
+	})
 }
 
 func (conn *tcpConn) Err(err error) {
@@ -451,7 +774,7 @@ func (conn *tcpConn) Err(err error) {
 
 	conn.release()
 	conn.state = tcpErrored
-	conn.canWrite.Broadcast()
+	conn.err = err
 }
 
 func (conn *tcpConn) LocalClosed() error {
@@ -463,10 +786,24 @@ func (conn *tcpConn) release() {
 	if _, found := tcpConns.Load(conn.connKey); found {
 		freeConnKeyArg(conn.connKeyArg)
 		tcpConns.Delete(conn.connKey)
+		atomic.AddInt32(&tcpConnCount, -1)
+		tcpIPCounts.remove(conn.ips)
+		conn.limiter.release()
+		close(conn.done)
 	}
-	conn.sndPipeWriter.Close()
-	conn.sndPipeReader.Close()
+	conn.closeRcvQueue()
 	conn.state = tcpClosed
+	conn.signalWrite()
+	conn.cancel()
+}
+
+// closeRcvQueue indicates no more data will be received, data already
+// queued can still be read.
+func (conn *tcpConn) closeRcvQueue() {
+	conn.rcvMu.Lock()
+	conn.rcvClosed = true
+	conn.rcvCond.Broadcast()
+	conn.rcvMu.Unlock()
 }
 
 func (conn *tcpConn) Poll() error {
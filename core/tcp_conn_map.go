@@ -37,6 +37,13 @@ import (
 
 var tcpConns sync.Map
 
+// Number of connections in tcpConns.
+var tcpConnCount int32
+
+// Whether the SYN-ACK of new connections is withheld until the handler
+// accepts them, only accessed by the loop goroutine.
+var deferTCPHandshake bool
+
 // We need such a key-value mechanism because when passing a Go pointer
 // to C, the Go pointer will only be valid during the call.
 // If we pass a Go pointer to tcp_arg(), this pointer will not be usable
@@ -0,0 +1,692 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpPeer plays the local client of a TCP connection going through the
+// stack, 10.0.0.1:1000 to 10.0.0.2:80.
+type tcpPeer struct {
+	t     testing.TB
+	stack LWIPStack
+
+	sync.Mutex
+	cond        *sync.Cond
+	seq         uint32 // Next sequence number to send.
+	ack         uint32 // Next sequence number expected from the stack.
+	established bool
+	acked       uint32 // Last acknowledgment number received.
+	wnd         uint32 // Last window received.
+	fin         bool   // Whether a FIN was received.
+	rst         bool   // Whether a RST was received.
+	rcvd        []byte // Data received.
+	icmp        []byte // Last ICMP message received.
+}
+
+func newTCPPeer(t testing.TB, stack LWIPStack) *tcpPeer {
+	p := &tcpPeer{t: t, stack: stack, seq: 1000}
+	p.cond = sync.NewCond(&p.Mutex)
+	RegisterOutputFn(p.output)
+	return p
+}
+
+// output receives segments output by the stack, it's called on the loop
+// goroutine.
+func (p *tcpPeer) output(pkt []byte) (int, error) {
+	iphLen := int(pkt[0]&0x0f) * 4
+	switch pkt[9] {
+	case proto_tcp:
+	case proto_icmp:
+		p.Lock()
+		p.icmp = append([]byte(nil), pkt...)
+		p.cond.Broadcast()
+		p.Unlock()
+		return len(pkt), nil
+	default:
+		return len(pkt), nil
+	}
+	tcph := pkt[iphLen:]
+	seq := binary.BigEndian.Uint32(tcph[4:8])
+	flags := tcph[13]
+	payload := tcph[int(tcph[12]>>4)*4:]
+
+	p.Lock()
+	defer p.Unlock()
+	if len(payload) > 0 {
+		if !p.established {
+			p.t.Error("data received before the SYN-ACK")
+		}
+		p.rcvd = append(p.rcvd, payload...)
+	}
+	if flags&tcpSYN != 0 && flags&tcpACK != 0 {
+		p.ack = seq + 1
+		p.established = true
+	}
+	if flags&tcpACK != 0 {
+		p.acked = binary.BigEndian.Uint32(tcph[8:12])
+		p.wnd = uint32(binary.BigEndian.Uint16(tcph[14:16]))
+	}
+	if flags&tcpFIN != 0 {
+		p.fin = true
+	}
+	if flags&tcpRST != 0 {
+		p.rst = true
+	}
+	p.cond.Broadcast()
+	return len(pkt), nil
+}
+
+func (p *tcpPeer) connect() {
+	write(p.stack, buildTCPv4Ack(p.seq, 0, tcpSYN, nil), p.t)
+	p.seq++
+
+	p.Lock()
+	for !p.established {
+		p.cond.Wait()
+	}
+	ack := p.ack
+	p.Unlock()
+	write(p.stack, buildTCPv4Ack(p.seq, ack, tcpACK, nil), p.t)
+}
+
+// segment returns the next data segment, waiting for the window to open.
+func (p *tcpPeer) segment(payload []byte) []byte {
+	p.Lock()
+	for p.seq+uint32(len(payload))-p.acked > p.wnd {
+		p.cond.Wait()
+	}
+	pkt := buildTCPv4Ack(p.seq, p.ack, tcpACK, payload)
+	p.seq += uint32(len(payload))
+	p.Unlock()
+	return pkt
+}
+
+type fakeTCPHandler struct {
+	accept func() // Called before accepting a connection, if set.
+	err    error  // Returned by Handle if set, the connection is refused.
+	conns  chan net.Conn
+	closed int32 // Number of calls to Close.
+}
+
+func (h *fakeTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	if h.accept != nil {
+		h.accept()
+	}
+	if h.err != nil {
+		return h.err
+	}
+	h.conns <- conn
+	return nil
+}
+
+func (h *fakeTCPHandler) Close() error {
+	atomic.AddInt32(&h.closed, 1)
+	return nil
+}
+
+func setupTCP(t testing.TB, h *fakeTCPHandler) (LWIPStack, *tcpPeer) {
+	return setupTCPWithOptions(t, h, nil)
+}
+
+func setupTCPWithOptions(t testing.TB, h *fakeTCPHandler, opts *StackOptions) (LWIPStack, *tcpPeer) {
+	h.conns = make(chan net.Conn, 1)
+	RegisterTCPConnHandler(h)
+	s := NewLWIPStackWithOptions(opts)
+	return s, newTCPPeer(t, s)
+}
+
+// readN reads n bytes from conn in a separate goroutine.
+func readN(conn net.Conn, n int) <-chan []byte {
+	ch := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, n)
+		n, _ := io.ReadFull(conn, buf)
+		ch <- buf[:n]
+	}()
+	return ch
+}
+
+// Out of sequence segments are kept by lwIP while the packet buffer is
+// reused.
+func TestTCPOutOfSequence(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	p.connect()
+	conn := <-h.conns
+
+	data := []byte("0123456789abcdefghij")
+	rcvd := readN(conn, len(data))
+	seg1 := p.segment(data[:10])
+	seg2 := p.segment(data[10:])
+	buf := make([]byte, len(seg2))
+	checkedCopy(buf, seg2, t)
+	write(s, buf, t)
+	checkedCopy(buf, seg1, t)
+	write(s, buf, t)
+
+	assertEqual(<-rcvd, data, t)
+}
+
+// Data refused while the handler is connecting is kept by lwIP while the
+// packet buffer is reused.
+func TestTCPRefusedData(t *testing.T) {
+	connecting := make(chan struct{})
+	h := &fakeTCPHandler{accept: func() { <-connecting }}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	p.connect()
+
+	data := []byte("0123456789")
+	seg := p.segment(data)
+	buf := make([]byte, len(seg))
+	checkedCopy(buf, seg, t)
+	write(s, buf, t)
+	for i := range buf {
+		buf[i] = 0
+	}
+	close(connecting)
+	rcvd := readN(<-h.conns, len(data))
+
+	assertEqual(<-rcvd, data, t)
+}
+
+// Data is queued while the handler doesn't read, without blocking the
+// stack, until the window is full.
+func TestTCPSlowReader(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	p.connect()
+	conn := <-h.conns
+
+	var data []byte
+	for {
+		p.Lock()
+		avail := int(p.acked + p.wnd - p.seq)
+		p.Unlock()
+		if avail == 0 {
+			break
+		}
+		if avail > 1000 {
+			avail = 1000
+		}
+		payload := make([]byte, avail)
+		for i := range payload {
+			payload[i] = byte(len(data) + i)
+		}
+		data = append(data, payload...)
+		write(s, p.segment(payload), t)
+
+		// Wait for the data to be acknowledged.
+		p.Lock()
+		for p.acked != p.seq {
+			p.cond.Wait()
+		}
+		p.Unlock()
+	}
+	if len(data) != DefaultTCPWindow {
+		t.Fatalf("%d bytes queued, want %d", len(data), DefaultTCPWindow)
+	}
+
+	assertEqual(<-readN(conn, len(data)), data, t)
+	p.Lock()
+	for p.wnd == 0 {
+		p.cond.Wait()
+	}
+	p.Unlock()
+}
+
+// Segments output together are flushed in a batch, referencing the pbufs
+// kept by lwIP for retransmission.
+func TestTCPOutputBatch(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	p.connect()
+	conn := <-h.conns
+
+	var batches []int
+	RegisterOutputBatchFn(func(pkts [][]byte) (int, error) {
+		// Called on the loop goroutine, like p.output.
+		batches = append(batches, len(pkts))
+		for _, pkt := range pkts {
+			if !validTCPChecksum(pkt) {
+				t.Error("invalid segment")
+			}
+			p.output(pkt)
+		}
+		return len(pkts), nil
+	})
+	defer RegisterOutputFn(p.output)
+
+	data := make([]byte, 4000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// The last segment is held back until the first ones are acknowledged.
+	rcvd := p.receiveAll(len(data))
+	assertEqual(rcvd, data, t)
+
+	var batched bool
+	loop.call(func() {
+		for _, n := range batches {
+			batched = batched || n > 1
+		}
+	})
+	if !batched {
+		t.Errorf("segments not batched: %v", batches)
+	}
+}
+
+// receiveAll acknowledges data from the stack as it arrives until n bytes
+// are received, and returns them. It fails if no data arrives for a second.
+func (p *tcpPeer) receiveAll(n int) []byte {
+	for rcvd := 0; rcvd < n; {
+		timedOut := false
+		timer := time.AfterFunc(time.Second, func() {
+			p.Lock()
+			timedOut = true
+			p.cond.Broadcast()
+			p.Unlock()
+		})
+		p.Lock()
+		for len(p.rcvd) == rcvd && !timedOut {
+			p.cond.Wait()
+		}
+		timer.Stop()
+		if len(p.rcvd) == rcvd {
+			p.Unlock()
+			p.t.Fatalf("received %d bytes, want %d", rcvd, n)
+		}
+		rcvd = len(p.rcvd)
+		ack := buildTCPv4Ack(p.seq, p.ack+uint32(rcvd), tcpACK, nil)
+		p.Unlock()
+		write(p.stack, ack, p.t)
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.rcvd
+}
+
+// Writes larger than 64 KiB fit in a send buffer of that size, they are
+// passed to lwIP in several calls.
+func TestTCPLargeSendBuffer(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCPWithOptions(t, h, &StackOptions{TCPSendBuffer: 256 * 1024})
+	defer s.Close()
+	p.connect()
+	conn := <-h.conns
+
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	written := make(chan error, 1)
+	go func() {
+		n, err := conn.Write(data)
+		if err == nil && n != len(data) {
+			err = fmt.Errorf("wrote %d bytes", n)
+		}
+		written <- err
+	}()
+	assertEqual(p.receiveAll(len(data)), data, t)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitRST waits for the stack to reset the connection.
+func (p *tcpPeer) waitRST() {
+	p.Lock()
+	for !p.rst {
+		p.cond.Wait()
+	}
+	p.Unlock()
+}
+
+// A connection refused by the handler is reset.
+func TestTCPHandleRefused(t *testing.T) {
+	h := &fakeTCPHandler{err: errors.New("connection refused")}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	p.connect()
+	p.waitRST()
+	if n := atomic.LoadInt32(&tcpConnCount); n != 0 {
+		t.Fatalf("%d connections left", n)
+	}
+}
+
+// Reading and writing fail with a reset error once the peer reset the
+// connection, data received before is still read.
+func TestTCPPeerReset(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	p.connect()
+	conn := <-h.conns
+
+	payload := []byte("hello")
+	write(s, p.segment(payload), t)
+	write(s, buildTCPv4Ack(p.seq, p.ack, tcpRST|tcpACK, nil), t)
+
+	b := make([]byte, 10)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(b[:n], payload, t)
+	if _, err := conn.Read(b); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("read: got %v, want a reset error", err)
+	}
+	if _, err := conn.Write(payload); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("write: got %v, want a reset error", err)
+	}
+}
+
+// ctxHandler passes its contexts to ctxs and waits for them to be done.
+type ctxHandler struct {
+	discardUDPHandler
+	ctxs chan context.Context
+}
+
+func newCtxHandler() *ctxHandler {
+	return &ctxHandler{ctxs: make(chan context.Context, 1)}
+}
+
+func (h *ctxHandler) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	h.ctxs <- ctx
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (h *ctxHandler) ConnectContext(ctx context.Context, conn UDPConn, target *net.UDPAddr) error {
+	h.ctxs <- ctx
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// waitDone waits for ctx to be done with err.
+func waitDone(ctx context.Context, err error, t *testing.T) {
+	select {
+	case <-ctx.Done():
+		if ctx.Err() != err {
+			t.Fatalf("context done with %v, want %v", ctx.Err(), err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not done")
+	}
+}
+
+// The context of the handler is cancelled when the peer resets the
+// connection.
+func TestTCPHandleContextReset(t *testing.T) {
+	h := newCtxHandler()
+	RegisterTCPConnHandler(TCPContextAdapter{h})
+	s := NewLWIPStack()
+	defer s.Close()
+	p := newTCPPeer(t, s)
+	p.connect()
+	ctx := <-h.ctxs
+
+	write(s, buildTCPv4Ack(p.seq, p.ack, tcpRST|tcpACK, nil), t)
+	waitDone(ctx, context.Canceled, t)
+}
+
+// The context of the handler expires after the dial timeout, the connection
+// is then reset.
+func TestTCPHandleContextTimeout(t *testing.T) {
+	h := newCtxHandler()
+	RegisterTCPConnHandler(TCPContextAdapter{h})
+	s := NewLWIPStackWithOptions(&StackOptions{DialTimeout: 10 * time.Millisecond})
+	defer s.Close()
+	p := newTCPPeer(t, s)
+	p.connect()
+
+	waitDone(<-h.ctxs, context.DeadlineExceeded, t)
+	p.waitRST()
+}
+
+// The SYN-ACK is withheld until the handler accepts the connection, data
+// written by the handler meanwhile follows the SYN-ACK.
+func TestTCPDeferHandshake(t *testing.T) {
+	release := make(chan struct{})
+	h := &fakeTCPHandler{}
+	h.accept = func() {
+		<-release
+	}
+	s, p := setupTCPWithOptions(t, h, &StackOptions{DeferTCPHandshake: true})
+	defer s.Close()
+
+	write(s, buildTCPv4Ack(p.seq, 0, tcpSYN, nil), t)
+	// Retransmitted, packets are modified by the stack so it's built again.
+	write(s, buildTCPv4Ack(p.seq, 0, tcpSYN, nil), t)
+	p.seq++
+	p.Lock()
+	established := p.established
+	p.Unlock()
+	if established {
+		t.Fatal("SYN-ACK sent before the connection was accepted")
+	}
+
+	close(release)
+	conn := <-h.conns
+	payload := []byte("hello")
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	p.Lock()
+	for !p.established {
+		p.cond.Wait()
+	}
+	p.Unlock()
+	write(s, buildTCPv4Ack(p.seq, p.ack, tcpACK, nil), t)
+
+	p.Lock()
+	for len(p.rcvd) < len(payload) {
+		p.cond.Wait()
+	}
+	assertEqual(p.rcvd, payload, t)
+	p.ack += uint32(len(payload))
+	p.Unlock()
+	write(s, p.segment(payload), t)
+	assertEqual(<-readN(conn, len(payload)), payload, t)
+}
+
+// A connection refused by the handler is reset without being established.
+func TestTCPDeferHandshakeRefused(t *testing.T) {
+	h := &fakeTCPHandler{err: errors.New("connection refused")}
+	s, p := setupTCPWithOptions(t, h, &StackOptions{DeferTCPHandshake: true})
+	defer s.Close()
+
+	write(s, buildTCPv4Ack(p.seq, 0, tcpSYN, nil), t)
+	p.waitRST()
+	if p.established {
+		t.Error("SYN-ACK sent for a refused connection")
+	}
+	if p.acked != p.seq+1 {
+		t.Errorf("RST acknowledges %d, want %d", p.acked, p.seq+1)
+	}
+}
+
+// The client is told if the destination is unreachable.
+func TestTCPDeferHandshakeUnreachable(t *testing.T) {
+	h := &fakeTCPHandler{err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}}
+	s, p := setupTCPWithOptions(t, h, &StackOptions{DeferTCPHandshake: true})
+	defer s.Close()
+
+	write(s, buildTCPv4Ack(p.seq, 0, tcpSYN, nil), t)
+	p.Lock()
+	for p.icmp == nil {
+		p.cond.Wait()
+	}
+	p.Unlock()
+	if p.established || p.rst {
+		t.Error("unexpected TCP segment")
+	}
+	if n := atomic.LoadInt32(&tcpConnCount); n != 0 {
+		t.Fatalf("%d connections left", n)
+	}
+
+	icmp := p.icmp
+	if checksum(icmp[:ipv4HeaderLen]) != 0 || checksum(icmp[ipv4HeaderLen:]) != 0 {
+		t.Error("wrong checksum")
+	}
+	if src, dst := ipAddrs(ipv4, icmp); !net.IP(src).Equal(net.IPv4(10, 0, 0, 2)) || !net.IP(dst).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("wrong addresses %v -> %v", net.IP(src), net.IP(dst))
+	}
+	icmph := icmp[ipv4HeaderLen:]
+	if icmph[0] != icmpv4DestUnreach || icmph[1] != 1 {
+		t.Errorf("got ICMP type %d code %d, want host unreachable", icmph[0], icmph[1])
+	}
+	quoted := icmph[icmpHeaderLen:]
+	tcph := quoted[ipv4HeaderLen:]
+	if binary.BigEndian.Uint16(tcph[0:2]) != 1000 || binary.BigEndian.Uint16(tcph[2:4]) != 80 || binary.BigEndian.Uint32(tcph[4:8]) != p.seq {
+		t.Error("wrong quoted SYN")
+	}
+}
+
+func timerArmed() bool {
+	var armed bool
+	loop.call(func() {
+		armed = loop.armed
+	})
+	return armed
+}
+
+// lwIP timers only run while there are connections.
+func TestTCPTimers(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	defer s.Close()
+	if timerArmed() {
+		t.Fatal("timer armed without connections")
+	}
+
+	p.connect()
+	conn := <-h.conns
+	if !timerArmed() {
+		t.Fatal("timer not armed with a connection")
+	}
+
+	conn.(TCPConn).Abort()
+	if timerArmed() {
+		t.Fatal("timer armed after the connection was aborted")
+	}
+}
+
+// Closing the stack gracefully lets connections finish.
+func TestTCPCloseContext(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	p.connect()
+	<-h.conns
+
+	closed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		closed <- s.CloseContext(ctx)
+	}()
+
+	// The stack closes its side, then the peer.
+	p.Lock()
+	for !p.fin {
+		p.cond.Wait()
+	}
+	p.Unlock()
+	write(s, buildTCPv4Ack(p.seq, p.ack+1, tcpFIN|tcpACK, nil), t)
+
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if p.rst {
+		t.Error("connection reset")
+	}
+	if atomic.LoadInt32(&h.closed) != 1 {
+		t.Error("handler not closed")
+	}
+}
+
+// Connections not finished in time are reset.
+func TestTCPCloseContextTimeout(t *testing.T) {
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(t, h)
+	p.connect()
+	<-h.conns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	p.Lock()
+	defer p.Unlock()
+	if !p.fin || !p.rst {
+		t.Error("connection not closed then reset")
+	}
+	if atomic.LoadInt32(&h.closed) != 1 {
+		t.Error("handler not closed")
+	}
+}
+
+type countingWriter struct {
+	n    int
+	done chan struct{}
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n -= len(b)
+	if w.n == 0 {
+		close(w.done)
+	}
+	return len(b), nil
+}
+
+func benchmarkTCPReceive(b *testing.B, copyFn func(io.Writer, io.Reader) (int64, error)) {
+	const mss = 1460
+	h := &fakeTCPHandler{}
+	s, p := setupTCP(b, h)
+	defer s.Close()
+	p.connect()
+	conn := <-h.conns
+
+	w := &countingWriter{n: b.N * mss, done: make(chan struct{})}
+	go copyFn(w, conn)
+
+	payload := make([]byte, mss)
+	b.SetBytes(mss)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Write(p.segment(payload))
+	}
+	<-w.done
+}
+
+// BenchmarkTCPReceive measures the receive path from input to a handler
+// relaying data with io.Copy.
+func BenchmarkTCPReceive(b *testing.B) {
+	benchmarkTCPReceive(b, io.Copy)
+}
+
+// BenchmarkTCPReceiveRead is like BenchmarkTCPReceive, with data read by
+// Read calls.
+func BenchmarkTCPReceiveRead(b *testing.B) {
+	benchmarkTCPReceive(b, func(w io.Writer, r io.Reader) (int64, error) {
+		buf := make([]byte, 32*1024)
+		return io.CopyBuffer(w, struct{ io.Reader }{r}, buf)
+	})
+}
@@ -30,33 +30,43 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 	connId := udpConnId{
 		src: srcAddr.String(),
 	}
+	var buf []byte
+	var totlen = int(p.tot_len)
+	if p.tot_len == p.len {
+		buf = (*[1 << 30]byte)(unsafe.Pointer(p.payload))[:totlen:totlen]
+	} else {
+		buf = NewBytes(totlen)
+		defer FreeBytes(buf)
+		C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0)
+	}
+
+	if udpACLRefused(srcAddr, dstAddr, buf[:totlen]) {
+		return
+	}
+
 	conn, found := udpConns.Load(connId)
 	if !found {
+		if refuseConns {
+			// The stack is being closed.
+			return
+		}
 		if udpConnHandler == nil {
 			panic("must register a UDP connection handler")
 		}
+		makeUDPRoom(newIPPair(srcAddr.IP, dstAddr.IP))
 		var err error
 		conn, err = newUDPConn(pcb,
 			udpConnHandler,
 			*addr,
 			port,
 			srcAddr,
-			dstAddr)
+			dstAddr,
+			buf[:totlen])
 		if err != nil {
 			return
 		}
 		udpConns.Store(connId, conn)
 	}
 
-	var buf []byte
-	var totlen = int(p.tot_len)
-	if p.tot_len == p.len {
-		buf = (*[1 << 30]byte)(unsafe.Pointer(p.payload))[:totlen:totlen]
-	} else {
-		buf = NewBytes(totlen)
-		defer FreeBytes(buf)
-		C.pbuf_copy_partial(p, unsafe.Pointer(&buf[0]), p.tot_len, 0)
-	}
-
 	conn.(UDPConn).ReceiveTo(buf[:totlen], dstAddr)
 }
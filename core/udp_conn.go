@@ -6,10 +6,13 @@ package core
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -36,9 +39,20 @@ type udpConn struct {
 	localPort C.u16_t
 	state     udpConnState
 	pending   chan *udpPacket
+	cancel    context.CancelFunc // Cancels the context of the handler.
+	meta      *ConnMetadata
+	limiter   *connLimiter
+	ips       ipPair
+	active    int64 // When data was last received or sent, in Unix nanoseconds.
+
+	// The first datagram, quoted in the ICMP message sent if Connect
+	// fails. It's nil unless StackOptions.UDPUnreachable is set.
+	quote []byte
 }
 
-func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr) (UDPConn, error) {
+// newUDPConn creates a connection and passes it to handler, data is the
+// payload of the first datagram.
+func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr, data []byte) (UDPConn, error) {
 	conn := &udpConn{
 		handler:   handler,
 		pcb:       pcb,
@@ -47,28 +61,58 @@ func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr
 		localPort: localPort,
 		state:     udpConnecting,
 		pending:   make(chan *udpPacket, 64), // To hold the early packets on the connection
+		meta:      newConnMetadata(localAddr, remoteAddr, remoteAddr.IP),
+		limiter:   newConnLimiter(localAddr.IP, remoteAddr.IP),
+		ips:       newIPPair(localAddr.IP, remoteAddr.IP),
+		active:    time.Now().UnixNano(),
+	}
+	udpIPCounts.add(conn.ips)
+	atomic.AddInt32(&udpConnCount, 1)
+	ctx, cancel := handlerContext()
+	conn.cancel = cancel
+	if atomic.LoadInt32(&udpUnreachable) != 0 {
+		conn.quote = buildUDP(localAddr, remoteAddr, data)
 	}
 
 	go func() {
-		err := handler.Connect(conn, remoteAddr)
+		err := ConnectUDP(ctx, handler, conn, remoteAddr)
+		cancel()
+		quote := conn.quote
+		conn.quote = nil
 		if err != nil {
 			conn.Close()
+			if quote != nil {
+				sendUDPUnreachable(quote, err)
+			}
 		} else {
 			conn.Lock()
-			conn.state = udpConnected
+			closed := conn.state == udpClosed
+			if !closed {
+				conn.state = udpConnected
+			}
+			pending := conn.pending
+			conn.pending = nil
 			conn.Unlock()
+			if closed {
+				// The session was closed while connecting, e.g. evicted
+				// or by the stack closing, maybe before the handler knew
+				// it. Pending data is dropped.
+				if h, ok := unwrapHandler(handler).(UDPConnCloseHandler); ok {
+					h.CloseConn(conn)
+				}
+				return
+			}
 			// Once connected, send all pending data.
 		DrainPending:
 			for {
 				select {
-				case pkt := <-conn.pending:
+				case pkt := <-pending:
 					err := conn.handler.ReceiveTo(conn, pkt.data, pkt.addr)
 					if err != nil {
 						break DrainPending
 					}
 					continue DrainPending
 				default:
-					conn.pending = nil
 					break DrainPending
 				}
 			}
@@ -78,6 +122,32 @@ func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr
 	return conn, nil
 }
 
+// sendUDPUnreachable sends an ICMP destination unreachable message quoting
+// the datagram pkt to the client. The port is reported unreachable unless
+// err means the host or network is.
+func sendUDPUnreachable(pkt []byte, err error) {
+	reason, ok := unreachError(err)
+	if !ok {
+		reason = unreachPort
+	}
+	icmp, err := buildICMPUnreachable(reason, pkt)
+	if err != nil {
+		return
+	}
+	loop.post(func() {
+		outputPacket(icmp)
+	})
+}
+
+func (conn *udpConn) Metadata() *ConnMetadata {
+	return conn.meta
+}
+
+// lastActive returns when data was last received or sent.
+func (conn *udpConn) lastActive() int64 {
+	return atomic.LoadInt64(&conn.active)
+}
+
 func (conn *udpConn) LocalAddr() *net.UDPAddr {
 	return conn.localAddr
 }
@@ -115,6 +185,11 @@ func (conn *udpConn) enqueueEarlyPacket(data []byte, addr *net.UDPAddr) bool {
 }
 
 func (conn *udpConn) ReceiveTo(data []byte, addr *net.UDPAddr) error {
+	if !conn.limiter.allow(len(data)) {
+		// Dropped, over the rate limits.
+		return nil
+	}
+	atomic.StoreInt64(&conn.active, time.Now().UnixNano())
 	if conn.enqueueEarlyPacket(data, addr) {
 		return nil
 	}
@@ -135,24 +210,55 @@ func (conn *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
 	if err := conn.checkState(); err != nil {
 		return 0, err
 	}
-	// FIXME any memory leaks?
+	if !conn.limiter.allow(len(data)) {
+		// Dropped, over the rate limits.
+		return len(data), nil
+	}
+	atomic.StoreInt64(&conn.active, time.Now().UnixNano())
 	cremoteIP := C.struct_ip_addr{}
 	if err := ipAddrATON(addr.IP.String(), &cremoteIP); err != nil {
 		return 0, err
 	}
-	buf := C.pbuf_alloc_reference(unsafe.Pointer(&data[0]), C.u16_t(len(data)), C.PBUF_ROM)
-	defer C.pbuf_free(buf)
-	C.udp_sendto(conn.pcb, buf, &conn.localIP, conn.localPort, &cremoteIP, C.u16_t(addr.Port))
+	// Data is copied as the packet is sent asynchronously by the loop
+	// goroutine, WriteFrom may be called from ReceiveTo, i.e. on the loop
+	// goroutine.
+	buf := C.pbuf_alloc(C.PBUF_TRANSPORT, C.u16_t(len(data)), C.PBUF_RAM)
+	if buf == nil {
+		return 0, errors.New("pbuf allocation failed")
+	}
+	C.pbuf_take(buf, unsafe.Pointer(&data[0]), C.u16_t(len(data)))
+	remotePort := C.u16_t(addr.Port)
+	loop.post(func() {
+		// The pcb is removed once the stack is closed, after its
+		// connections.
+		if conn.checkState() == nil {
+			C.udp_sendto(conn.pcb, buf, &conn.localIP, conn.localPort, &cremoteIP, remotePort)
+		}
+		C.pbuf_free(buf)
+	})
 	return len(data), nil
 }
 
+// Close closes the session, the closed state is final so that its counts
+// and limiter are released once.
 func (conn *udpConn) Close() error {
 	connId := udpConnId{
 		src: conn.LocalAddr().String(),
 	}
 	conn.Lock()
-	conn.state = udpClosed
+	closed := conn.state == udpClosed
+	if !closed {
+		conn.state = udpClosed
+		conn.limiter.release()
+		udpIPCounts.remove(conn.ips)
+		atomic.AddInt32(&udpConnCount, -1)
+	}
 	conn.Unlock()
-	udpConns.Delete(connId)
+	conn.cancel()
+	if !closed {
+		// A later session from the same address may be stored once
+		// the session is closed.
+		udpConns.Delete(connId)
+	}
 	return nil
 }
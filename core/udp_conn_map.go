@@ -6,6 +6,10 @@ import (
 
 var udpConns sync.Map
 
+// Whether an ICMP destination unreachable message is sent when Connect fails
+// for a new connection, set if non-zero.
+var udpUnreachable int32
+
 type udpConnId struct {
 	src string
 }
@@ -0,0 +1,363 @@
+// Package group implements a handler spreading connections over several
+// upstream handlers, e.g. one per proxy server, so that a dead upstream
+// doesn't take the whole tunnel down.
+//
+// Upstreams are probed periodically, connections go to the healthy ones
+// as chosen by the strategy. If an upstream fails to handle a connection,
+// the next candidate is tried. When all upstreams fail their probes, all
+// of them are tried anyway.
+package group
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Strategy is how a group chooses the upstream of a new connection.
+type Strategy int
+
+const (
+	// Failover uses the first healthy upstream in order.
+	Failover Strategy = iota
+
+	// RoundRobin takes turns between healthy upstreams.
+	RoundRobin
+
+	// LowestLatency uses the healthy upstream with the lowest probe
+	// latency, upstreams not probed yet come last.
+	LowestLatency
+)
+
+var strategyNames = []string{"failover", "round-robin", "lowest-latency"}
+
+func (s Strategy) String() string {
+	if s >= 0 && int(s) < len(strategyNames) {
+		return strategyNames[s]
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy returns the strategy named s, as printed by String.
+func ParseStrategy(s string) (Strategy, error) {
+	for i, name := range strategyNames {
+		if s == name {
+			return Strategy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strategy %q", s)
+}
+
+// Upstream is a member of a group.
+type Upstream struct {
+	// Name identifies the upstream in logs and status.
+	Name string
+
+	// TCP handles TCP connections.
+	TCP core.TCPConnHandler
+
+	// UDP handles UDP sessions, upstreams without are not used for UDP.
+	UDP core.UDPConnHandler
+
+	// Probe checks that the upstream works, e.g. by connecting to a well
+	// known address through it. Upstreams without probe are always
+	// healthy.
+	Probe func(ctx context.Context) error
+}
+
+// Options are the options of a group.
+type Options struct {
+	Strategy Strategy
+
+	// ProbeInterval is the interval between health probes, zero disables
+	// probing.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout is the time after which a probe fails, 5 seconds if
+	// zero.
+	ProbeTimeout time.Duration
+}
+
+type upstream struct {
+	Upstream
+
+	mu      sync.Mutex
+	healthy bool
+	latency time.Duration
+	err     error
+}
+
+func (u *upstream) health() (bool, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy, u.latency
+}
+
+// setHealth records the result of a probe taking d.
+func (u *upstream) setHealth(err error, d time.Duration) {
+	u.mu.Lock()
+	wasHealthy := u.healthy
+	u.healthy = err == nil
+	u.err = err
+	if err == nil {
+		u.latency = d
+	}
+	u.mu.Unlock()
+
+	if wasHealthy && err != nil {
+		log.Warnf("upstream %v is down: %v", u.Name, err)
+	} else if !wasHealthy && err == nil {
+		log.Infof("upstream %v is up, latency %v", u.Name, d)
+	}
+}
+
+// Group is a TCP and UDP handler passing connections on to its upstreams.
+type Group struct {
+	upstreams []*upstream
+	strategy  Strategy
+	next      uint32
+
+	// UDP sessions by the stack's UDPConn.
+	conns sync.Map
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New returns a group of upstreams, which are healthy until probed
+// otherwise. Probing starts at once if enabled, until Stop is called.
+func New(upstreams []Upstream, opts Options) *Group {
+	g := &Group{strategy: opts.Strategy, stop: make(chan struct{})}
+	for i, u := range upstreams {
+		if u.Name == "" {
+			u.Name = fmt.Sprintf("#%d", i)
+		}
+		g.upstreams = append(g.upstreams, &upstream{Upstream: u, healthy: true})
+	}
+	if opts.ProbeInterval > 0 {
+		timeout := opts.ProbeTimeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		g.wg.Add(1)
+		go g.probeLoop(opts.ProbeInterval, timeout)
+	}
+	return g
+}
+
+func (g *Group) probeLoop(interval, timeout time.Duration) {
+	defer g.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		g.probe(timeout)
+		select {
+		case <-t.C:
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// probe probes all upstreams concurrently.
+func (g *Group) probe(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, u := range g.upstreams {
+		if u.Probe == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			err := u.Probe(ctx)
+			u.setHealth(err, time.Since(start))
+		}(u)
+	}
+	wg.Wait()
+}
+
+// Stop stops probing upstreams.
+func (g *Group) Stop() {
+	g.stopOnce.Do(func() { close(g.stop) })
+	g.wg.Wait()
+}
+
+// candidates returns the upstreams to try in order for a new connection.
+func (g *Group) candidates(udp bool) []*upstream {
+	var healthy, all []*upstream
+	latencies := make(map[*upstream]time.Duration)
+	for _, u := range g.upstreams {
+		if udp && u.UDP == nil || !udp && u.TCP == nil {
+			continue
+		}
+		all = append(all, u)
+		if ok, latency := u.health(); ok {
+			healthy = append(healthy, u)
+			if latency == 0 {
+				latency = math.MaxInt64
+			}
+			latencies[u] = latency
+		}
+	}
+	if len(healthy) == 0 {
+		return all
+	}
+
+	switch g.strategy {
+	case RoundRobin:
+		i := int(atomic.AddUint32(&g.next, 1)-1) % len(healthy)
+		healthy = append(healthy[i:], healthy[:i]...)
+	case LowestLatency:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return latencies[healthy[i]] < latencies[healthy[j]]
+		})
+	}
+	return healthy
+}
+
+func (g *Group) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return g.HandleContext(context.Background(), conn, target)
+}
+
+// HandleContext passes conn to the upstreams in turn until one handles it.
+func (g *Group) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	err := errors.New("no upstream for TCP")
+	for _, u := range g.candidates(false) {
+		if err = core.HandleTCP(ctx, u.TCP, conn, target); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		log.Warnf("upstream %v failed to handle connection to %v: %v", u.Name, target, err)
+	}
+	return err
+}
+
+// udpConn is a session passed to an upstream, it's forgotten by the group
+// once the upstream closes it.
+type udpConn struct {
+	core.UDPConn
+	g  *Group
+	up *upstream
+}
+
+func (c *udpConn) Close() error {
+	c.g.conns.Delete(c.UDPConn)
+	return c.UDPConn.Close()
+}
+
+func (g *Group) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return g.ConnectContext(context.Background(), conn, target)
+}
+
+// ConnectContext connects conn with the upstreams in turn until one
+// succeeds, the upstream is then used for the whole session.
+func (g *Group) ConnectContext(ctx context.Context, conn core.UDPConn, target *net.UDPAddr) error {
+	err := errors.New("no upstream for UDP")
+	for _, u := range g.candidates(true) {
+		c := &udpConn{UDPConn: conn, g: g, up: u}
+		g.conns.Store(conn, c)
+		if err = core.ConnectUDP(ctx, u.UDP, c, target); err == nil {
+			return nil
+		}
+		g.conns.Delete(conn)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Warnf("upstream %v failed to connect session %v: %v", u.Name, conn.LocalAddr(), err)
+	}
+	return err
+}
+
+func (g *Group) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	v, ok := g.conns.Load(conn)
+	if !ok {
+		return fmt.Errorf("session %v not connected", conn.LocalAddr())
+	}
+	c := v.(*udpConn)
+	return c.up.UDP.ReceiveTo(c, data, addr)
+}
+
+// CloseConn tells the upstream of conn that the stack closed it.
+func (g *Group) CloseConn(conn core.UDPConn) {
+	v, ok := g.conns.Load(conn)
+	if !ok {
+		return
+	}
+	g.conns.Delete(conn)
+	c := v.(*udpConn)
+	if h, ok := c.up.UDP.(core.UDPConnCloseHandler); ok {
+		h.CloseConn(c)
+	}
+}
+
+// Close closes the upstream handlers implementing core.HandlerCloser, a
+// handler shared by upstreams is closed once. Probing goes on until Stop is
+// called.
+func (g *Group) Close() error {
+	var err error
+	closed := make(map[interface{}]bool)
+	for _, u := range g.upstreams {
+		for _, h := range []interface{}{u.TCP, u.UDP} {
+			c, ok := h.(core.HandlerCloser)
+			if !ok {
+				continue
+			}
+			if reflect.TypeOf(h).Comparable() {
+				if closed[h] {
+					continue
+				}
+				closed[h] = true
+			}
+			if e := c.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// UpstreamStatus is the health of an upstream.
+type UpstreamStatus struct {
+	Name    string
+	Healthy bool
+	Latency time.Duration
+	Error   string `json:",omitempty"`
+}
+
+// Status returns the health of the upstreams in order.
+func (g *Group) Status() []UpstreamStatus {
+	var s []UpstreamStatus
+	for _, u := range g.upstreams {
+		u.mu.Lock()
+		st := UpstreamStatus{Name: u.Name, Healthy: u.healthy, Latency: u.latency}
+		if u.err != nil {
+			st.Error = u.err.Error()
+		}
+		u.mu.Unlock()
+		s = append(s, st)
+	}
+	return s
+}
+
+// String returns the status of the upstreams in JSON.
+func (g *Group) String() string {
+	b, _ := json.Marshal(g.Status())
+	return string(b)
+}
@@ -0,0 +1,303 @@
+package group
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"github.com/eycorsican/go-tun2socks/proxy/socks"
+)
+
+// socksServer is a SOCKS5 server stand-in supporting CONNECT without
+// authentication.
+type socksServer struct {
+	ln    net.Listener
+	delay time.Duration
+	conns int32
+}
+
+func newSOCKSServer(t *testing.T, delay time.Duration) *socksServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{ln: ln, delay: delay}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(c net.Conn) {
+	defer c.Close()
+	atomic.AddInt32(&s.conns, 1)
+	time.Sleep(s.delay)
+
+	buf := make([]byte, 262)
+	// Version and methods.
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	c.Write([]byte{5, 0})
+	// Request with an IPv4 or domain address.
+	if _, err := io.ReadFull(c, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(c, buf[:n]); err != nil {
+			return
+		}
+		host = string(buf[:n])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	remote, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer remote.Close()
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	core.Relay(c, remote)
+}
+
+func (s *socksServer) count() int {
+	return int(atomic.LoadInt32(&s.conns))
+}
+
+func (s *socksServer) upstream(name, target string) Upstream {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	host, port := addr.IP.String(), uint16(addr.Port)
+	return Upstream{
+		Name:  name,
+		TCP:   socks.NewTCPHandler(host, port),
+		Probe: socks.NewProbe(host, port, target),
+	}
+}
+
+// echoServer returns the address of a TCP echo server.
+func echoServer(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// echo handles a connection to target with g and checks data comes back.
+func echo(t *testing.T, g *Group, target *net.TCPAddr) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	if err := g.Handle(conn, target); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello")
+	go client.Write(data)
+	buf := make([]byte, len(data))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != string(data) {
+		t.Fatalf("echoed %q: %v", buf, err)
+	}
+}
+
+// deadServer returns an upstream whose proxy server refuses connections.
+func deadServer(t *testing.T, target string) Upstream {
+	s := newSOCKSServer(t, 0)
+	s.ln.Close()
+	return s.upstream("dead", target)
+}
+
+func TestFailover(t *testing.T) {
+	target := echoServer(t)
+	s1, s2 := newSOCKSServer(t, 0), newSOCKSServer(t, 0)
+	g := New([]Upstream{
+		deadServer(t, target.String()),
+		s1.upstream("s1", target.String()),
+		s2.upstream("s2", target.String()),
+	}, Options{})
+	for i := 0; i < 2; i++ {
+		echo(t, g, target)
+	}
+	if s1.count() != 2 || s2.count() != 0 {
+		t.Errorf("%d and %d connections, want 2 and 0", s1.count(), s2.count())
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	target := echoServer(t)
+	s1, s2 := newSOCKSServer(t, 0), newSOCKSServer(t, 0)
+	g := New([]Upstream{
+		s1.upstream("s1", target.String()),
+		s2.upstream("s2", target.String()),
+	}, Options{Strategy: RoundRobin})
+	for i := 0; i < 4; i++ {
+		echo(t, g, target)
+	}
+	if s1.count() != 2 || s2.count() != 2 {
+		t.Errorf("%d and %d connections, want 2 and 2", s1.count(), s2.count())
+	}
+}
+
+// waitProbed waits until the upstreams of g are probed.
+func waitProbed(t *testing.T, g *Group, healthy ...bool) []UpstreamStatus {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status := g.Status()
+		probed := true
+		for i, s := range status {
+			if s.Healthy != healthy[i] || s.Healthy && s.Latency == 0 {
+				probed = false
+			}
+		}
+		if probed {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upstreams not probed: %v", g)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLowestLatency(t *testing.T) {
+	target := echoServer(t)
+	slow, fast := newSOCKSServer(t, 50*time.Millisecond), newSOCKSServer(t, 0)
+	g := New([]Upstream{
+		slow.upstream("slow", target.String()),
+		fast.upstream("fast", target.String()),
+	}, Options{Strategy: LowestLatency, ProbeInterval: time.Hour})
+	defer g.Stop()
+	waitProbed(t, g, true, true)
+
+	echo(t, g, target)
+	if slow.count() != 1 || fast.count() != 2 {
+		t.Errorf("%d and %d connections, want 1 and 2", slow.count(), fast.count())
+	}
+}
+
+// Upstreams failing their probes are skipped.
+func TestHealthProbe(t *testing.T) {
+	target := echoServer(t)
+	s1, s2 := newSOCKSServer(t, 0), newSOCKSServer(t, 0)
+	g := New([]Upstream{
+		s1.upstream("s1", target.String()),
+		s2.upstream("s2", target.String()),
+	}, Options{ProbeInterval: 20 * time.Millisecond})
+	defer g.Stop()
+	waitProbed(t, g, true, true)
+
+	s1.ln.Close()
+	status := waitProbed(t, g, false, true)
+	if status[0].Error == "" {
+		t.Error("no probe error")
+	}
+	n1 := s1.count()
+	echo(t, g, target)
+	if s1.count() != n1 {
+		t.Error("connection through an unhealthy upstream")
+	}
+
+	// All upstreams are tried when all are unhealthy.
+	g.Stop()
+	g.upstreams[1].setHealth(errors.New("down"), 0)
+	echo(t, g, target)
+}
+
+// fakeUDPConn is a session from the stack.
+type fakeUDPConn struct {
+	core.UDPConn
+	closed int32
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+}
+
+func (c *fakeUDPConn) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+// fakeUDPHandler fails to connect if broken, and records the sessions it
+// receives data from.
+type fakeUDPHandler struct {
+	broken   bool
+	received chan core.UDPConn
+}
+
+func (h *fakeUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if h.broken {
+		return errors.New("broken")
+	}
+	return nil
+}
+
+func (h *fakeUDPHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.received <- conn
+	return nil
+}
+
+// A session keeps the upstream it was connected with.
+func TestUDP(t *testing.T) {
+	h1 := &fakeUDPHandler{broken: true}
+	h2 := &fakeUDPHandler{received: make(chan core.UDPConn, 1)}
+	g := New([]Upstream{{Name: "h1", UDP: h1}, {Name: "h2", UDP: h2}}, Options{})
+
+	conn := &fakeUDPConn{}
+	if err := g.ConnectContext(context.Background(), conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ReceiveTo(conn, []byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	c := <-h2.received
+	c.Close()
+	if atomic.LoadInt32(&conn.closed) != 1 {
+		t.Error("session not closed")
+	}
+	if err := g.ReceiveTo(conn, []byte("hello"), nil); err == nil {
+		t.Error("closed session still connected")
+	}
+}
@@ -1,7 +1,7 @@
 package redirect
 
 import (
-	"io"
+	"context"
 	"net"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
@@ -31,57 +31,24 @@ type tcpHandler struct {
 	target string
 }
 
-type duplexConn interface {
-	net.Conn
-	CloseWrite() error
-	CloseRead() error
-}
-
 func NewTCPHandler(target string) core.TCPConnHandler {
 	return &tcpHandler{target: target}
 }
 
-func (h *tcpHandler) handleInput(conn net.Conn, input io.ReadCloser) {
-	defer func() {
-		if tcpConn, ok := conn.(core.TCPConn); ok {
-			tcpConn.CloseWrite()
-		} else {
-			conn.Close()
-		}
-		if tcpInput, ok := input.(duplexConn); ok {
-			tcpInput.CloseRead()
-		} else {
-			input.Close()
-		}
-	}()
-
-	io.Copy(conn, input)
-}
-
-func (h *tcpHandler) handleOutput(conn net.Conn, output io.WriteCloser) {
-	defer func() {
-		if tcpConn, ok := conn.(core.TCPConn); ok {
-			tcpConn.CloseRead()
-		} else {
-			conn.Close()
-		}
-		if tcpOutput, ok := output.(duplexConn); ok {
-			tcpOutput.CloseWrite()
-		} else {
-			output.Close()
-		}
-	}()
-
-	io.Copy(output, conn)
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return h.HandleContext(context.Background(), conn, target)
 }
 
-func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	c, err := net.Dial("tcp", h.target)
+func (h *tcpHandler) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", h.target)
 	if err != nil {
 		return err
 	}
-	go h.handleInput(conn, c)
-	go h.handleOutput(conn, c)
+	go func() {
+		up, down, err := core.Relay(conn, c)
+		log.Debugf("proxy connection for target %s:%s closed, %d bytes up, %d bytes down, error: %v", target.Network(), target.String(), up, down, err)
+	}()
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
@@ -33,7 +33,7 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, pc *net.UDPConn) {
 	buf := core.NewBytes(core.BufSize)
 
 	defer func() {
-		h.Close(conn)
+		h.closeConn(conn)
 		core.FreeBytes(buf)
 	}()
 
@@ -88,7 +88,27 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	}
 }
 
-func (h *udpHandler) Close(conn core.UDPConn) {
+// Close closes all UDP sessions, it's called when the stack is closed.
+func (h *udpHandler) Close() error {
+	h.Lock()
+	conns := make([]core.UDPConn, 0, len(h.udpConns))
+	for conn := range h.udpConns {
+		conns = append(conns, conn)
+	}
+	h.Unlock()
+
+	for _, conn := range conns {
+		h.closeConn(conn)
+	}
+	return nil
+}
+
+// CloseConn releases the proxy resources of a session closed by the stack.
+func (h *udpHandler) CloseConn(conn core.UDPConn) {
+	h.closeConn(conn)
+}
+
+func (h *udpHandler) closeConn(conn core.UDPConn) {
 	conn.Close()
 
 	h.Lock()
@@ -0,0 +1,100 @@
+package socks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// HostTable maps the IP addresses clients were given for hostnames, e.g.
+// the fake IPs of a DNS server, to the hostnames. UDP datagrams to these
+// addresses are sent to the proxy server with the hostname, and replies
+// from the hostname are mapped back.
+type HostTable interface {
+	// Hostname returns the hostname ip was given for.
+	Hostname(ip net.IP) (string, bool)
+
+	// IP returns the IP given for hostname.
+	IP(hostname string) (net.IP, bool)
+}
+
+const (
+	// How long resolved hostnames are cached, and failures remembered.
+	resolvedTTL = time.Minute
+	failedTTL   = 10 * time.Second
+
+	// Number of cached hostnames above which expired ones are removed.
+	maxResolved = 1024
+)
+
+type resolved struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// resolveCache resolves hostnames in the background, for replies from the
+// proxy server carrying a hostname no client was given an IP for.
+type resolveCache struct {
+	mu      sync.Mutex
+	hosts   map[string]resolved
+	pending map[string]bool
+	lookup  func(host string) (net.IP, error)
+}
+
+func newResolveCache(lookup func(host string) (net.IP, error)) *resolveCache {
+	return &resolveCache{
+		hosts:   make(map[string]resolved),
+		pending: make(map[string]bool),
+		lookup:  lookup,
+	}
+}
+
+func lookupIP(host string) (net.IP, error) {
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+var hostCache = newResolveCache(lookupIP)
+
+// get returns the IP of host without blocking, nil if it's not resolved
+// yet or failed. Missing or expired hostnames are looked up in the
+// background, an expired IP is returned meanwhile.
+func (c *resolveCache) get(host string) net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.hosts[host]
+	if ok && time.Now().Before(r.expires) {
+		return r.ip
+	}
+	if !c.pending[host] {
+		c.pending[host] = true
+		go c.resolve(host)
+	}
+	return r.ip
+}
+
+func (c *resolveCache) resolve(host string) {
+	ip, err := c.lookup(host)
+	ttl := resolvedTTL
+	if err != nil {
+		ip, ttl = nil, failedTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.hosts) >= maxResolved {
+		for h, r := range c.hosts {
+			if now.After(r.expires) {
+				delete(c.hosts, h)
+			}
+		}
+	}
+	c.hosts[host] = resolved{ip: ip, expires: now.Add(ttl)}
+	delete(c.pending, host)
+}
@@ -67,6 +67,31 @@ func (a Addr) String() string {
 	return net.JoinHostPort(host, port)
 }
 
+func (a Addr) port() int {
+	return int(a[len(a)-2])<<8 | int(a[len(a)-1])
+}
+
+// UDPAddr returns a copy of the IP address and port of a, nil if a is a
+// domain name.
+func (a Addr) UDPAddr() *net.UDPAddr {
+	switch ATYP(a[0]) {
+	case socks5IP4:
+		return &net.UDPAddr{IP: append(net.IP(nil), a[1:1+net.IPv4len]...), Port: a.port()}
+	case socks5IP6:
+		return &net.UDPAddr{IP: append(net.IP(nil), a[1:1+net.IPv6len]...), Port: a.port()}
+	}
+	return nil
+}
+
+// Domain returns the domain name and port of a, an empty name if a is an
+// IP address.
+func (a Addr) Domain() (string, int) {
+	if ATYP(a[0]) != socks5Domain {
+		return "", 0
+	}
+	return string(a[2 : 2+int(a[1])]), a.port()
+}
+
 // ParseAddr parses the address in string s. Returns nil if failed.
 func ParseAddr(s string) Addr {
 	var addr Addr
@@ -1,7 +1,7 @@
 package socks
 
 import (
-	"io"
+	"context"
 	"net"
 	"sync"
 
@@ -25,80 +25,43 @@ func NewTCPHandler(proxyHost string, proxyPort uint16) core.TCPConnHandler {
 	}
 }
 
-type direction byte
-
-const (
-	dirUplink direction = iota
-	dirDownlink
-)
-
-type duplexConn interface {
-	net.Conn
-	CloseRead() error
-	CloseWrite() error
-}
-
-func (h *tcpHandler) relay(lhs, rhs net.Conn) {
-	upCh := make(chan struct{})
-
-	cls := func(dir direction, interrupt bool) {
-		lhsDConn, lhsOk := lhs.(duplexConn)
-		rhsDConn, rhsOk := rhs.(duplexConn)
-		if !interrupt && lhsOk && rhsOk {
-			switch dir {
-			case dirUplink:
-				lhsDConn.CloseRead()
-				rhsDConn.CloseWrite()
-			case dirDownlink:
-				lhsDConn.CloseWrite()
-				rhsDConn.CloseRead()
-			default:
-				panic("unexpected direction")
-			}
-		} else {
-			lhs.Close()
-			rhs.Close()
-		}
-	}
-
-	// Uplink
-	go func() {
-		var err error
-		_, err = io.Copy(rhs, lhs)
-		if err != nil {
-			cls(dirUplink, true) // interrupt the conn if the error is not nil (not EOF)
-		} else {
-			cls(dirUplink, false) // half close uplink direction of the TCP conn if possible
-		}
-		upCh <- struct{}{}
-	}()
-
-	// Downlink
-	var err error
-	_, err = io.Copy(lhs, rhs)
-	if err != nil {
-		cls(dirDownlink, true)
-	} else {
-		cls(dirDownlink, false)
-	}
-
-	<-upCh // Wait for uplink done.
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return h.HandleContext(context.Background(), conn, target)
 }
 
-func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+func (h *tcpHandler) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
 	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), nil, nil)
 	if err != nil {
 		return err
 	}
 
-	c, err := dialer.Dial(target.Network(), target.String())
+	c, err := dialer.(proxy.ContextDialer).DialContext(ctx, target.Network(), target.String())
 	if err != nil {
 		return err
 	}
 
-	go h.relay(conn, c)
+	go func() {
+		up, down, err := core.Relay(conn, c)
+		log.Debugf("proxy connection to %v closed, %d bytes up, %d bytes down, error: %v", target, up, down, err)
+	}()
 
 	log.Infof("new proxy connection to %v", target)
 
 	return nil
 }
+
+// NewProbe returns a health probe connecting target through the proxy
+// server, for use with proxy/group.
+func NewProbe(proxyHost string, proxyPort uint16, target string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(proxyHost, proxyPort).String(), nil, nil)
+		if err != nil {
+			return err
+		}
+		c, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
@@ -1,10 +1,12 @@
 package socks
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,88 +17,232 @@ import (
 // max IP packet size - min IP header size - min UDP header size - min SOCKS5 header size
 const maxUdpPayloadSize = 65535 - 20 - 8 - 7
 
+// Maximum number of idle associations kept for reuse.
+const maxIdleAssociations = 16
+
+// associationQuiet is how long no datagram must have arrived on an idle
+// association before it's reused, so that late replies to a closed session
+// don't reach the next one.
+var associationQuiet = 2 * time.Second
+
+// association is a UDP ASSOCIATE with the proxy server, it's used by one
+// session at a time and kept for the next session once the session closes.
+type association struct {
+	tcp   net.Conn       // control connection keeping the association alive
+	pc    net.PacketConn // local socket datagrams are relayed from
+	relay *net.UDPAddr   // UDP relay server address
+
+	// Guarded by the handler's mutex.
+	conn     core.UDPConn // session using the association, nil if idle
+	lastRecv time.Time
+	closed   bool
+	hostIPs  map[string]net.IP // IPs of the hostnames the session sent to
+}
+
+func (a *association) close() {
+	a.tcp.Close()
+	a.pc.Close()
+}
+
 type udpHandler struct {
 	sync.Mutex
 
-	proxyHost   string
-	proxyPort   uint16
-	udpConns    map[core.UDPConn]net.PacketConn
-	tcpConns    map[core.UDPConn]net.Conn
-	remoteAddrs map[core.UDPConn]*net.UDPAddr // UDP relay server addresses
-	timeout     time.Duration
+	proxyHost string
+	proxyPort uint16
+	sessions  map[core.UDPConn]*association
+	idle      []*association
+	timeout   time.Duration
+	hosts     HostTable
 }
 
 func NewUDPHandler(proxyHost string, proxyPort uint16, timeout time.Duration) core.UDPConnHandler {
+	return NewUDPHandlerWithHostTable(proxyHost, proxyPort, timeout, nil)
+}
+
+// NewUDPHandlerWithHostTable returns a UDP handler sending datagrams to the
+// addresses in hosts with their hostname, hosts may be nil.
+func NewUDPHandlerWithHostTable(proxyHost string, proxyPort uint16, timeout time.Duration, hosts HostTable) core.UDPConnHandler {
 	return &udpHandler{
-		proxyHost:   proxyHost,
-		proxyPort:   proxyPort,
-		udpConns:    make(map[core.UDPConn]net.PacketConn, 8),
-		tcpConns:    make(map[core.UDPConn]net.Conn, 8),
-		remoteAddrs: make(map[core.UDPConn]*net.UDPAddr, 8),
-		timeout:     timeout,
+		proxyHost: proxyHost,
+		proxyPort: proxyPort,
+		sessions:  make(map[core.UDPConn]*association, 8),
+		timeout:   timeout,
+		hosts:     hosts,
 	}
 }
 
-func (h *udpHandler) handleTCP(conn core.UDPConn, c net.Conn) {
+// handleTCP closes a once the proxy server closes the control connection.
+func (h *udpHandler) handleTCP(a *association) {
 	buf := core.NewBytes(core.BufSize)
 
 	defer func() {
-		h.Close(conn)
+		h.closeAssociation(a)
 		core.FreeBytes(buf)
 	}()
 
 	for {
-		c.SetDeadline(time.Time{})
-		if _, err := c.Read(buf); err != nil {
+		if _, err := a.tcp.Read(buf); err != nil {
 			return
 		}
 	}
 }
 
-func (h *udpHandler) fetchUDPInput(conn core.UDPConn, input net.PacketConn) {
+// fetchUDPInput passes datagrams from the relay server to the session
+// using a. Sessions receiving nothing for the timeout are closed, and so
+// is a once it's idle for the timeout.
+func (h *udpHandler) fetchUDPInput(a *association) {
 	buf := core.NewBytes(maxUdpPayloadSize)
 
 	defer func() {
-		h.Close(conn)
+		h.closeAssociation(a)
 		core.FreeBytes(buf)
 	}()
 
 	for {
-		input.SetDeadline(time.Now().Add(h.timeout))
-		n, _, err := input.ReadFrom(buf)
+		a.pc.SetReadDeadline(time.Now().Add(h.timeout))
+		n, _, err := a.pc.ReadFrom(buf)
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				h.Lock()
+				conn := a.conn
+				h.Unlock()
+				if conn != nil {
+					h.closeConn(conn)
+					continue
+				}
+			}
 			return
 		}
+
+		h.Lock()
+		conn := a.conn
+		a.lastRecv = time.Now()
+		h.Unlock()
+		if conn == nil {
+			continue
+		}
+
+		// RSV RSV FRAG
 		if n < 3 {
 			continue
 		}
+		if buf[2] != 0 {
+			log.Debugf("dropped fragmented datagram to %v", conn.LocalAddr())
+			continue
+		}
 		addr := SplitAddr(buf[3:n])
 		if addr == nil {
 			continue
 		}
-		resolvedAddr, err := net.ResolveUDPAddr("udp", addr.String())
-		if err != nil {
+		resolvedAddr := h.replyAddr(a, addr)
+		if resolvedAddr == nil {
 			continue
 		}
 		_, err = conn.WriteFrom(buf[int(3+len(addr)):n], resolvedAddr)
 		if err != nil {
 			log.Warnf("write local failed: %v", err)
-			return
+			h.closeConn(conn)
+		}
+	}
+}
+
+// replyAddr returns the address replies from addr come from on the TUN
+// side, nil if unknown. A hostname is mapped to the IP the session sent to
+// it, the IP in the host table, or its cached resolution, which is started
+// in the background if missing.
+func (h *udpHandler) replyAddr(a *association, addr Addr) *net.UDPAddr {
+	host, port := addr.Domain()
+	if host == "" {
+		return addr.UDPAddr()
+	}
+	h.Lock()
+	ip := a.hostIPs[host]
+	h.Unlock()
+	if ip == nil && h.hosts != nil {
+		ip, _ = h.hosts.IP(host)
+	}
+	if ip == nil {
+		if ip = hostCache.get(host); ip == nil {
+			log.Debugf("dropped datagram from unresolved %v", addr)
+			return nil
 		}
 	}
+	return &net.UDPAddr{IP: ip, Port: port}
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return h.ConnectContext(context.Background(), conn, target)
+}
+
+func (h *udpHandler) ConnectContext(ctx context.Context, conn core.UDPConn, target *net.UDPAddr) error {
 	if target == nil {
-		return h.connectInternal(conn, "")
+		return h.connectInternal(ctx, conn, "")
+	}
+	return h.connectInternal(ctx, conn, target.String())
+}
+
+func (h *udpHandler) connectInternal(ctx context.Context, conn core.UDPConn, dest string) error {
+	if a := h.reuseAssociation(conn); a != nil {
+		log.Debugf("reusing UDP association %v for %v", a.pc.LocalAddr(), conn.LocalAddr())
+	} else {
+		a, err := h.associate(ctx)
+		if err != nil {
+			return err
+		}
+
+		h.Lock()
+		a.conn = conn
+		h.sessions[conn] = a
+		h.Unlock()
+
+		go h.handleTCP(a)
+		go h.fetchUDPInput(a)
+	}
+
+	log.Infof("new proxy connection to %v", dest)
+
+	return nil
+}
+
+// reuseAssociation gives conn the most recently used idle association
+// which is quiet, if any.
+func (h *udpHandler) reuseAssociation(conn core.UDPConn) *association {
+	h.Lock()
+	defer h.Unlock()
+
+	for i := len(h.idle) - 1; i >= 0; i-- {
+		if a := h.idle[i]; time.Since(a.lastRecv) >= associationQuiet {
+			h.idle = append(h.idle[:i], h.idle[i+1:]...)
+			a.conn = conn
+			a.hostIPs = nil
+			h.sessions[conn] = a
+			return a
+		}
 	}
-	return h.connectInternal(conn, target.String())
+	return nil
 }
 
-func (h *udpHandler) connectInternal(conn core.UDPConn, dest string) error {
-	c, err := net.DialTimeout("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), 4*time.Second)
+// associate sets up a new association with the proxy server.
+func (h *udpHandler) associate(ctx context.Context) (_ *association, err error) {
+	d := net.Dialer{Timeout: 4 * time.Second}
+	c, err := d.DialContext(ctx, "tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String())
 	if err != nil {
-		return err
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			c.Close()
+			pc.Close()
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		// The handshake is bounded too.
+		c.SetDeadline(deadline)
 	}
 
 	// send VER, NMETHODS, METHODS
@@ -105,85 +251,152 @@ func (h *udpHandler) connectInternal(conn core.UDPConn, dest string) error {
 	buf := make([]byte, MaxAddrLen)
 	// read VER METHOD
 	if _, err := io.ReadFull(c, buf[:2]); err != nil {
-		return err
+		return nil, err
 	}
 
-	c.Write(append([]byte{5, socks5UDPAssociate, 0}, []byte{1, 0, 0, 0, 0, 0, 0}...))
-	
+	// The local address datagrams are sent from, its IP is left unspecified
+	// as it may be translated on the way to the proxy server.
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	c.Write([]byte{5, socks5UDPAssociate, 0, socks5IP4, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+
 	// read VER REP RSV ATYP BND.ADDR BND.PORT
 	if _, err := io.ReadFull(c, buf[:3]); err != nil {
-		return err
+		return nil, err
 	}
 
 	rep := buf[1]
 	if rep != 0 {
-		return errors.New("SOCKS handshake failed")
+		return nil, errors.New("SOCKS handshake failed")
 	}
 
 	remoteAddr, err := readAddr(c, buf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	resolvedRemoteAddr, err := net.ResolveUDPAddr("udp", remoteAddr.String())
 	if err != nil {
-		return errors.New("failed to resolve remote address")
+		return nil, errors.New("failed to resolve remote address")
 	}
-
-	go h.handleTCP(conn, c)
-
-	pc, err := net.ListenPacket("udp", "")
-	if err != nil {
-		return err
+	if resolvedRemoteAddr.IP.IsUnspecified() {
+		// The relay server is on the proxy host.
+		resolvedRemoteAddr.IP = c.RemoteAddr().(*net.TCPAddr).IP
 	}
 
-	h.Lock()
-	h.tcpConns[conn] = c
-	h.udpConns[conn] = pc
-	h.remoteAddrs[conn] = resolvedRemoteAddr
-	h.Unlock()
-
-	go h.fetchUDPInput(conn, pc)
+	c.SetDeadline(time.Time{})
 
-	log.Infof("new proxy connection to %v", dest)
-
-	return nil
+	return &association{tcp: c, pc: pc, relay: resolvedRemoteAddr}, nil
 }
 
 func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	var host string
+	if h.hosts != nil {
+		if name, ok := h.hosts.Hostname(addr.IP); ok && len(name) <= 255 {
+			host = name
+		}
+	}
+
 	h.Lock()
-	pc, ok1 := h.udpConns[conn]
-	remoteAddr, ok2 := h.remoteAddrs[conn]
+	a, ok := h.sessions[conn]
+	if ok && host != "" {
+		if a.hostIPs == nil {
+			a.hostIPs = make(map[string]net.IP)
+		}
+		a.hostIPs[host] = append(net.IP(nil), addr.IP...)
+	}
 	h.Unlock()
 
-	if ok1 && ok2 {
-		buf := append([]byte{0, 0, 0}, ParseAddr(addr.String())...)
+	if ok {
+		target := ParseAddr(addr.String())
+		if host != "" {
+			target = ParseAddr(net.JoinHostPort(host, strconv.Itoa(addr.Port)))
+		}
+		buf := append([]byte{0, 0, 0}, target...)
 		buf = append(buf, data[:]...)
-		_, err := pc.WriteTo(buf, remoteAddr)
+		_, err := a.pc.WriteTo(buf, a.relay)
 		if err != nil {
-			h.Close(conn)
+			h.closeAssociation(a)
 			return errors.New(fmt.Sprintf("write remote failed: %v", err))
 		}
 		return nil
 	} else {
-		h.Close(conn)
+		h.closeConn(conn)
 		return errors.New(fmt.Sprintf("proxy connection %v->%v does not exists", conn.LocalAddr(), addr))
 	}
 }
 
-func (h *udpHandler) Close(conn core.UDPConn) {
+// Close closes all UDP sessions and associations, it's called when the
+// stack is closed.
+func (h *udpHandler) Close() error {
+	h.Lock()
+	associations := h.idle
+	h.idle = nil
+	for _, a := range h.sessions {
+		associations = append(associations, a)
+	}
+	h.Unlock()
+
+	for _, a := range associations {
+		h.closeAssociation(a)
+	}
+	return nil
+}
+
+// CloseConn releases the proxy resources of a session closed by the stack.
+func (h *udpHandler) CloseConn(conn core.UDPConn) {
+	h.closeConn(conn)
+}
+
+// closeConn closes a session, its association is kept for reuse unless
+// there are enough idle ones.
+func (h *udpHandler) closeConn(conn core.UDPConn) {
 	conn.Close()
 
 	h.Lock()
-	defer h.Unlock()
+	a, ok := h.sessions[conn]
+	if !ok {
+		h.Unlock()
+		return
+	}
+	delete(h.sessions, conn)
+	a.conn = nil
+	if a.closed {
+		h.Unlock()
+		return
+	}
+	if len(h.idle) < maxIdleAssociations {
+		h.idle = append(h.idle, a)
+		h.Unlock()
+		return
+	}
+	a.closed = true
+	h.Unlock()
 
-	if c, ok := h.tcpConns[conn]; ok {
-		c.Close()
-		delete(h.tcpConns, conn)
+	a.close()
+}
+
+// closeAssociation closes a, and the session using it if any.
+func (h *udpHandler) closeAssociation(a *association) {
+	h.Lock()
+	if a.closed {
+		h.Unlock()
+		return
+	}
+	a.closed = true
+	conn := a.conn
+	if conn != nil {
+		delete(h.sessions, conn)
+	}
+	for i, idle := range h.idle {
+		if idle == a {
+			h.idle = append(h.idle[:i], h.idle[i+1:]...)
+			break
+		}
 	}
-	if pc, ok := h.udpConns[conn]; ok {
-		pc.Close()
-		delete(h.udpConns, conn)
+	h.Unlock()
+
+	a.close()
+	if conn != nil {
+		conn.Close()
 	}
-	delete(h.remoteAddrs, conn)
 }
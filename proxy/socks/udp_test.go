@@ -0,0 +1,234 @@
+package socks
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// udpServer is a SOCKS5 server stand-in supporting UDP ASSOCIATE, with a
+// relay echoing datagrams back after a fragment which must be dropped.
+type udpServer struct {
+	ln           net.Listener
+	relay        net.PacketConn
+	associations int32
+	ports        chan int    // requested and actual client ports
+	targets      chan string // targets of relayed datagrams
+}
+
+func newUDPServer(t *testing.T) *udpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &udpServer{ln: ln, relay: relay, ports: make(chan int, 4), targets: make(chan string, 4)}
+	go s.serve()
+	go s.echo()
+	return s
+}
+
+func (s *udpServer) close() {
+	s.ln.Close()
+	s.relay.Close()
+}
+
+func (s *udpServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			buf := make([]byte, MaxAddrLen)
+			if _, err := io.ReadFull(c, buf[:3]); err != nil {
+				return
+			}
+			c.Write([]byte{5, 0})
+			if _, err := io.ReadFull(c, buf[:3]); err != nil || buf[1] != socks5UDPAssociate {
+				return
+			}
+			addr, err := readAddr(c, buf)
+			if err != nil {
+				return
+			}
+			s.ports <- int(addr[len(addr)-2])<<8 | int(addr[len(addr)-1])
+			atomic.AddInt32(&s.associations, 1)
+
+			// The relay is on the proxy host.
+			port := s.relay.LocalAddr().(*net.UDPAddr).Port
+			c.Write([]byte{5, 0, 0, socks5IP4, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+			io.Copy(ioutil.Discard, c)
+		}()
+	}
+}
+
+func (s *udpServer) echo() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.ports <- addr.(*net.UDPAddr).Port
+		if target := SplitAddr(buf[3:n]); target != nil {
+			s.targets <- target.String()
+		}
+		frag := append([]byte(nil), buf[:n]...)
+		frag[2] = 1
+		s.relay.WriteTo(frag, addr)
+		s.relay.WriteTo(buf[:n], addr)
+	}
+}
+
+// fakeUDPConn is a session from the stack, passing datagrams written to
+// it to received.
+type fakeUDPConn struct {
+	core.UDPConn
+	received chan string
+}
+
+func newFakeUDPConn() *fakeUDPConn {
+	return &fakeUDPConn{received: make(chan string, 4)}
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+}
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.received <- addr.String() + " " + string(data)
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error {
+	return nil
+}
+
+// roundTrip sends data to target through conn and checks the echo.
+func roundTrip(t *testing.T, h core.UDPConnHandler, conn *fakeUDPConn, target *net.UDPAddr, data string) {
+	if err := h.ReceiveTo(conn, []byte(data), target); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-conn.received:
+		if want := target.String() + " " + data; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reply")
+	}
+	select {
+	case got := <-conn.received:
+		t.Errorf("unexpected datagram %q", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// Associations are reused by later sessions, the relay address defaults to
+// the proxy host and fragments are dropped.
+func TestUDPAssociation(t *testing.T) {
+	defer func(d time.Duration) { associationQuiet = d }(associationQuiet)
+	associationQuiet = 0
+	s := newUDPServer(t)
+	defer s.close()
+	addr := s.ln.Addr().(*net.TCPAddr)
+	h := NewUDPHandler(addr.IP.String(), uint16(addr.Port), time.Minute)
+
+	conn1 := newFakeUDPConn()
+	if err := h.Connect(conn1, nil); err != nil {
+		t.Fatal(err)
+	}
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	roundTrip(t, h, conn1, target, "hello")
+	if requested, actual := <-s.ports, <-s.ports; requested != actual {
+		t.Errorf("associated port %d, datagrams sent from %d", requested, actual)
+	}
+	h.(core.UDPConnCloseHandler).CloseConn(conn1)
+
+	conn2 := newFakeUDPConn()
+	if err := h.Connect(conn2, nil); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, h, conn2, target, "again")
+	if n := atomic.LoadInt32(&s.associations); n != 1 {
+		t.Errorf("%d associations", n)
+	}
+
+	h.(core.HandlerCloser).Close()
+	if err := h.ReceiveTo(conn2, []byte("closed"), conn2.LocalAddr()); err == nil {
+		t.Error("session still open")
+	}
+}
+
+// hostTable maps IPs to hostnames.
+type hostTable map[string]string
+
+func (t hostTable) Hostname(ip net.IP) (string, bool) {
+	host, ok := t[ip.String()]
+	return host, ok
+}
+
+func (t hostTable) IP(hostname string) (net.IP, bool) {
+	for ip, host := range t {
+		if host == hostname {
+			return net.ParseIP(ip), true
+		}
+	}
+	return nil, false
+}
+
+// Datagrams to addresses in the host table carry the hostname, replies
+// from it are mapped back.
+func TestUDPDomainTarget(t *testing.T) {
+	s := newUDPServer(t)
+	defer s.close()
+	addr := s.ln.Addr().(*net.TCPAddr)
+	h := NewUDPHandlerWithHostTable(addr.IP.String(), uint16(addr.Port), time.Minute, hostTable{"198.18.0.1": "example.com"})
+	defer h.(core.HandlerCloser).Close()
+
+	conn := newFakeUDPConn()
+	if err := h.Connect(conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, h, conn, &net.UDPAddr{IP: net.IPv4(198, 18, 0, 1), Port: 53}, "hello")
+	if target := <-s.targets; target != "example.com:53" {
+		t.Errorf("datagram sent to %v", target)
+	}
+}
+
+// Hostnames are resolved in the background once.
+func TestResolveCache(t *testing.T) {
+	var lookups int32
+	release := make(chan struct{})
+	c := newResolveCache(func(host string) (net.IP, error) {
+		atomic.AddInt32(&lookups, 1)
+		<-release
+		return net.IPv4(192, 0, 2, 1), nil
+	})
+	for i := 0; i < 2; i++ {
+		if ip := c.get("example.com"); ip != nil {
+			t.Fatalf("got %v before resolution", ip)
+		}
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for c.get("example.com") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("not resolved")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("%d lookups", n)
+	}
+}
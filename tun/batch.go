@@ -0,0 +1,32 @@
+package tun
+
+import (
+	"io"
+)
+
+// BatchWriter is implemented by TUN devices able to write several packets
+// in one call.
+type BatchWriter interface {
+	WriteBatch(pkts [][]byte) (int, error)
+}
+
+// WriteBatch writes pkts to dev, using dev's WriteBatch method if it
+// implements BatchWriter, or writing packets one by one otherwise. It
+// returns the number of packets written.
+func WriteBatch(dev io.Writer, pkts [][]byte) (int, error) {
+	if bw, ok := dev.(BatchWriter); ok {
+		return bw.WriteBatch(pkts)
+	}
+	for i, pkt := range pkts {
+		if _, err := dev.Write(pkt); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// VectorWriter is implemented by TUN devices able to write a single packet
+// gathered from several buffers in one system call.
+type VectorWriter interface {
+	WriteBuffers(bufs [][]byte) (int, error)
+}
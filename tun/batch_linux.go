@@ -0,0 +1,71 @@
+package tun
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
+)
+
+// batchTunDev is a TUN device writing batches of packets in a single pass
+// over its non-blocking file descriptor. A TUN device takes one packet per
+// write(2), and it's not a socket sendmmsg(2) could be used on, so a batch
+// still takes one system call per packet, but the runtime poller is only
+// involved once per batch unless the device queue is full.
+type batchTunDev struct {
+	io.ReadWriteCloser
+	rawConn syscall.RawConn
+}
+
+// newBatchTunDev returns dev as a BatchWriter if its file can be written
+// directly, or dev itself otherwise.
+func newBatchTunDev(dev *water.Interface) io.ReadWriteCloser {
+	sc, ok := dev.ReadWriteCloser.(syscall.Conn)
+	if !ok {
+		return dev
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return dev
+	}
+	return &batchTunDev{ReadWriteCloser: dev, rawConn: rawConn}
+}
+
+// WriteBatch writes pkts with one write(2) each, waiting for the device to
+// be writable again if its queue is full. It returns the number of packets
+// written.
+func (dev *batchTunDev) WriteBatch(pkts [][]byte) (int, error) {
+	var n int
+	var errno syscall.Errno
+	err := dev.rawConn.Write(func(fd uintptr) bool {
+		for n < len(pkts) {
+			pkt := pkts[n]
+			if len(pkt) == 0 {
+				n++
+				continue
+			}
+			_, _, e := unix.Syscall(unix.SYS_WRITE, fd, uintptr(unsafe.Pointer(&pkt[0])), uintptr(len(pkt)))
+			switch e {
+			case 0:
+				n++
+			case unix.EINTR:
+			case unix.EAGAIN:
+				return false
+			default:
+				errno = e
+				return true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	if errno != 0 {
+		return n, os.NewSyscallError("write", errno)
+	}
+	return n, nil
+}
@@ -0,0 +1,109 @@
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// countingRawConn counts the passes over the file descriptor when writing.
+type countingRawConn struct {
+	syscall.RawConn
+	passes int32
+}
+
+func (c *countingRawConn) Write(f func(fd uintptr) bool) error {
+	return c.RawConn.Write(func(fd uintptr) bool {
+		atomic.AddInt32(&c.passes, 1)
+		return f(fd)
+	})
+}
+
+// newTestDev returns a device writing to a packet socket standing in for
+// the TUN file descriptor, and the peer socket packets are read from.
+func newTestDev(t *testing.T, sndbuf int) (*batchTunDev, *countingRawConn, *os.File) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sndbuf > 0 {
+		if err := unix.SetsockoptInt(fds[0], unix.SOL_SOCKET, unix.SO_SNDBUF, sndbuf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, peer := os.NewFile(uintptr(fds[0]), "dev"), os.NewFile(uintptr(fds[1]), "peer")
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingRawConn{RawConn: rawConn}
+	return &batchTunDev{ReadWriteCloser: file, rawConn: counting}, counting, peer
+}
+
+func testPackets(n, size int) [][]byte {
+	pkts := make([][]byte, n)
+	for i := range pkts {
+		pkts[i] = bytes.Repeat([]byte{byte(i)}, size)
+	}
+	return pkts
+}
+
+// readPackets reads len(want) packets from peer and compares them to want.
+func readPackets(peer *os.File, want [][]byte) error {
+	buf := make([]byte, 2048)
+	for i, pkt := range want {
+		n, err := peer.Read(buf)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(buf[:n], pkt) {
+			return fmt.Errorf("packet %d: got %d bytes, want %d", i, n, len(pkt))
+		}
+	}
+	return nil
+}
+
+// A batch is written in a single pass, each packet on its own.
+func TestWriteBatch(t *testing.T) {
+	dev, rawConn, peer := newTestDev(t, 0)
+	defer dev.Close()
+	defer peer.Close()
+
+	pkts := testPackets(8, 100)
+	if n, err := WriteBatch(dev, pkts); n != len(pkts) || err != nil {
+		t.Fatalf("wrote %d packets: %v", n, err)
+	}
+	if passes := atomic.LoadInt32(&rawConn.passes); passes != 1 {
+		t.Errorf("%d passes, want 1", passes)
+	}
+	if err := readPackets(peer, pkts); err != nil {
+		t.Error(err)
+	}
+}
+
+// Writing resumes once the device queue has room.
+func TestWriteBatchFull(t *testing.T) {
+	dev, rawConn, peer := newTestDev(t, 4096)
+	defer dev.Close()
+	defer peer.Close()
+
+	pkts := testPackets(64, 1500)
+	done := make(chan error, 1)
+	go func() {
+		done <- readPackets(peer, pkts)
+	}()
+	if n, err := WriteBatch(dev, pkts); n != len(pkts) || err != nil {
+		t.Fatalf("wrote %d packets: %v", n, err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if passes := atomic.LoadInt32(&rawConn.passes); passes < 2 {
+		t.Errorf("%d passes, the queue was never full", passes)
+	}
+}
@@ -0,0 +1,169 @@
+package tun
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Offload flags for TUNSETOFFLOAD, see linux/if_tun.h.
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+)
+
+// Length of struct virtio_net_hdr.
+const virtioNetHdrLen = 10
+
+type ifReq struct {
+	Name  [unix.IFNAMSIZ]byte
+	Flags uint16
+	pad   [0x28 - unix.IFNAMSIZ - 2]byte
+}
+
+// offloadTunDev is a TUN device opened with IFF_VNET_HDR, each packet read
+// from or written to it is prefixed with a virtio-net header.
+type offloadTunDev struct {
+	*os.File
+	rawConn syscall.RawConn
+	name    string
+}
+
+func openOffloadTunDev(name string, persist, multiQueue bool) (*offloadTunDev, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var req ifReq
+	req.Flags = unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR
+	if multiQueue {
+		req.Flags |= unix.IFF_MULTI_QUEUE
+	}
+	copy(req.Name[:], name)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("ioctl", errno)
+	}
+
+	value := 0
+	if persist {
+		value = 1
+	}
+	if err := unix.IoctlSetInt(fd, unix.TUNSETPERSIST, value); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// Let the kernel hand us TCP super-segments with partial checksums, and
+	// accept such segments from us.
+	if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// The file is registered to the runtime poller since fd is non-blocking.
+	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &offloadTunDev{
+		File:    file,
+		rawConn: rawConn,
+		name:    string(req.Name[:clen(req.Name[:])]),
+	}, nil
+}
+
+func clen(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// WriteBuffers writes a single packet gathered from bufs with writev(2).
+func (dev *offloadTunDev) WriteBuffers(bufs [][]byte) (int, error) {
+	iovs := make([]unix.Iovec, 0, len(bufs))
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+		iov := unix.Iovec{Base: &buf[0]}
+		iov.SetLen(len(buf))
+		iovs = append(iovs, iov)
+	}
+	if len(iovs) == 0 {
+		return 0, nil
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := dev.rawConn.Write(func(fd uintptr) bool {
+		r, _, e := unix.Syscall(unix.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+		if e == unix.EAGAIN {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("writev", errno)
+	}
+	return n, nil
+}
+
+// Write writes a plain IP packet, prefixing it with an empty virtio-net
+// header.
+func (dev *offloadTunDev) Write(pkt []byte) (int, error) {
+	var hdr [virtioNetHdrLen]byte
+	n, err := dev.WriteBuffers([][]byte{hdr[:], pkt})
+	if n > 0 {
+		n -= len(hdr)
+	}
+	return n, err
+}
+
+// OpenOffloadTunDevice opens a TUN device with IFF_VNET_HDR and TCP
+// segmentation offloads enabled, with the given number of queues. Packets
+// read from the returned devices are prefixed with a virtio-net header and
+// may be TCP super-segments, Write takes plain IP packets, and the devices
+// implement VectorWriter for writing packets prefixed with a virtio-net
+// header.
+func OpenOffloadTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool, mtu int, queues int) ([]io.ReadWriteCloser, error) {
+	if queues < 1 {
+		return nil, errors.New("invalid number of queues")
+	}
+
+	devs := make([]io.ReadWriteCloser, 0, queues)
+	closeAll := func() {
+		for _, dev := range devs {
+			dev.Close()
+		}
+	}
+	for i := 0; i < queues; i++ {
+		dev, err := openOffloadTunDev(name, persist, queues > 1)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		name = dev.name
+		devs = append(devs, dev)
+	}
+	if err := setMTU(name, mtu); err != nil {
+		closeAll()
+		return nil, err
+	}
+	return devs, nil
+}
@@ -0,0 +1,119 @@
+package tun
+
+import (
+	"io"
+)
+
+// IP protocol numbers of the transport protocols whose ports are hashed.
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// FNV-1a parameters.
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+func fnv1a(h uint32, b []byte) uint32 {
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= fnvPrime
+	}
+	return h
+}
+
+// FlowQueue returns which of n queues IP packet pkt is written to, packets
+// of the same flow are always written to the same queue. The flow is given
+// by the addresses and protocol, and by the ports for TCP and UDP packets
+// which aren't fragmented. Packets too short to be parsed are written to the
+// first queue.
+func FlowQueue(pkt []byte, n int) int {
+	if n <= 1 || len(pkt) < 1 {
+		return 0
+	}
+	var addrs []byte
+	var proto byte
+	var iphLen int
+	fragmented := false
+	switch pkt[0] >> 4 {
+	case 4:
+		iphLen = int(pkt[0]&0x0f) * 4
+		if len(pkt) < 20 || len(pkt) < iphLen {
+			return 0
+		}
+		addrs, proto = pkt[12:20], pkt[9]
+		// More fragments flag or fragment offset set.
+		fragmented = pkt[6]&0x3f != 0 || pkt[7] != 0
+	case 6:
+		iphLen = 40
+		if len(pkt) < iphLen {
+			return 0
+		}
+		// Packets with extension headers, e.g. fragments, are hashed
+		// without ports.
+		addrs, proto = pkt[8:40], pkt[6]
+	default:
+		return 0
+	}
+
+	h := fnv1a(fnvOffset, addrs)
+	h = fnv1a(h, []byte{proto})
+	if (proto == protoTCP || proto == protoUDP) && !fragmented && len(pkt) >= iphLen+4 {
+		h = fnv1a(h, pkt[iphLen:iphLen+4])
+	}
+	return int(h % uint32(n))
+}
+
+// MultiQueueWriter writes packets to the queues of a multi-queue TUN
+// device, chosen by FlowQueue, so that writing is spread over the queues
+// while packets of a flow stay in order. It's not safe for concurrent use.
+type MultiQueueWriter struct {
+	queues  []io.Writer
+	batches [][][]byte // Packets of a batch per queue.
+}
+
+// NewMultiQueueWriter returns a writer to the queues devs, as returned by
+// OpenMultiQueueTunDevice.
+func NewMultiQueueWriter(devs []io.ReadWriteCloser) *MultiQueueWriter {
+	w := &MultiQueueWriter{
+		queues:  make([]io.Writer, len(devs)),
+		batches: make([][][]byte, len(devs)),
+	}
+	for i, dev := range devs {
+		w.queues[i] = dev
+	}
+	return w
+}
+
+// Write writes pkt to the queue of its flow.
+func (w *MultiQueueWriter) Write(pkt []byte) (int, error) {
+	return w.queues[FlowQueue(pkt, len(w.queues))].Write(pkt)
+}
+
+// WriteBatch writes pkts to the queues of their flows, a batch per queue.
+// It returns the number of packets written.
+func (w *MultiQueueWriter) WriteBatch(pkts [][]byte) (int, error) {
+	for _, pkt := range pkts {
+		q := FlowQueue(pkt, len(w.queues))
+		w.batches[q] = append(w.batches[q], pkt)
+	}
+	var written int
+	var err error
+	for q, batch := range w.batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if err == nil {
+			var n int
+			n, err = WriteBatch(w.queues[q], batch)
+			written += n
+		}
+		for i := range batch {
+			batch[i] = nil
+		}
+		w.batches[q] = batch[:0]
+	}
+	return written, err
+}
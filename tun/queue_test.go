@@ -0,0 +1,124 @@
+package tun
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// udpPacket builds an IPv4 UDP packet from 10.0.0.1:sport to 10.0.0.2:53.
+func udpPacket(sport uint16, payload byte) []byte {
+	pkt := make([]byte, 20+8+1)
+	pkt[0] = 0x45
+	pkt[9] = protoUDP
+	copy(pkt[12:16], []byte{10, 0, 0, 1})
+	copy(pkt[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(pkt[20:22], sport)
+	binary.BigEndian.PutUint16(pkt[22:24], 53)
+	pkt[28] = payload
+	return pkt
+}
+
+func TestFlowQueue(t *testing.T) {
+	const queues = 4
+	used := make(map[int]bool)
+	for sport := uint16(1000); sport < 1064; sport++ {
+		q := FlowQueue(udpPacket(sport, 0), queues)
+		if q2 := FlowQueue(udpPacket(sport, 1), queues); q2 != q {
+			t.Fatalf("flow from port %d written to queues %d and %d", sport, q, q2)
+		}
+		used[q] = true
+	}
+	if len(used) != queues {
+		t.Errorf("flows written to %d queues out of %d", len(used), queues)
+	}
+
+	// Fragments of a datagram are hashed without ports, all of them are
+	// written to the same queue.
+	frag := udpPacket(1000, 0)
+	frag[6] = 0x20 // More fragments.
+	q := FlowQueue(frag, queues)
+	frag[6], frag[7] = 0, 3
+	if q2 := FlowQueue(frag[:24], queues); q2 != q {
+		t.Errorf("fragments written to queues %d and %d", q, q2)
+	}
+
+	for _, pkt := range [][]byte{nil, {0x45, 0}, {0x60}} {
+		if q := FlowQueue(pkt, queues); q != 0 {
+			t.Errorf("short packet %x written to queue %d", pkt, q)
+		}
+	}
+}
+
+// queueRecorder records the packets written to it.
+type queueRecorder struct {
+	pkts    [][]byte
+	batches int
+}
+
+func (r *queueRecorder) Read(b []byte) (int, error) { return 0, nil }
+func (r *queueRecorder) Close() error               { return nil }
+
+func (r *queueRecorder) Write(pkt []byte) (int, error) {
+	r.pkts = append(r.pkts, pkt)
+	return len(pkt), nil
+}
+
+func (r *queueRecorder) WriteBatch(pkts [][]byte) (int, error) {
+	r.batches++
+	r.pkts = append(r.pkts, pkts...)
+	return len(pkts), nil
+}
+
+// Packets of a batch are written to the queues of their flows in order, in
+// a batch per queue.
+func TestMultiQueueWriter(t *testing.T) {
+	const queues = 4
+	recorders := make([]*queueRecorder, queues)
+	devs := make([]io.ReadWriteCloser, queues)
+	for i := range recorders {
+		recorders[i] = &queueRecorder{}
+		devs[i] = recorders[i]
+	}
+	w := NewMultiQueueWriter(devs)
+
+	var pkts [][]byte
+	for i := 0; i < 4; i++ {
+		for sport := uint16(1000); sport < 1016; sport++ {
+			pkts = append(pkts, udpPacket(sport, byte(i)))
+		}
+	}
+	if n, err := w.WriteBatch(pkts); n != len(pkts) || err != nil {
+		t.Fatalf("wrote %d packets: %v", n, err)
+	}
+
+	written := 0
+	for q, r := range recorders {
+		if len(r.pkts) > 0 && r.batches != 1 {
+			t.Errorf("queue %d written in %d batches", q, r.batches)
+		}
+		next := make(map[uint16]byte)
+		for _, pkt := range r.pkts {
+			if FlowQueue(pkt, queues) != q {
+				t.Fatalf("packet written to queue %d", q)
+			}
+			sport := binary.BigEndian.Uint16(pkt[20:22])
+			if pkt[28] != next[sport] {
+				t.Fatalf("packet %d of flow from port %d written out of order", pkt[28], sport)
+			}
+			next[sport]++
+		}
+		written += len(r.pkts)
+	}
+	if written != len(pkts) {
+		t.Errorf("%d packets written, want %d", written, len(pkts))
+	}
+
+	// Single packets go to the same queues.
+	pkt := udpPacket(1000, 4)
+	q := FlowQueue(pkt, queues)
+	w.Write(pkt)
+	if last := recorders[q].pkts[len(recorders[q].pkts)-1]; &last[0] != &pkt[0] {
+		t.Error("packet not written to the queue of its flow")
+	}
+}
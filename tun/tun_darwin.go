@@ -30,7 +30,7 @@ func isIPv6(ip net.IP) bool {
 	return false
 }
 
-func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool) (io.ReadWriteCloser, error) {
+func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool, mtu int) (io.ReadWriteCloser, error) {
 	tunDev, err := water.New(water.Config{
 		DeviceType: water.TUN,
 	})
@@ -55,6 +55,9 @@ func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist boo
 	} else {
 		return nil, errors.New("invalid IP address")
 	}
+	if mtu > 0 {
+		params = fmt.Sprintf("%s mtu %d", params, mtu)
+	}
 
 	out, err := exec.Command("ifconfig", strings.Split(params, " ")...).Output()
 	if err != nil {
@@ -65,3 +68,21 @@ func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist boo
 	}
 	return tunDev, nil
 }
+
+// OpenMultiQueueTunDevice opens the TUN device, multiple queues are only
+// supported on Linux, it fails if more than one queue is requested.
+func OpenMultiQueueTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool, mtu int, queues int) ([]io.ReadWriteCloser, error) {
+	if queues != 1 {
+		return nil, errors.New("multi-queue TUN device is only supported on Linux")
+	}
+	tunDev, err := OpenTunDevice(name, addr, gw, mask, dnsServers, persist, mtu)
+	if err != nil {
+		return nil, err
+	}
+	return []io.ReadWriteCloser{tunDev}, nil
+}
+
+// OpenOffloadTunDevice is only supported on Linux.
+func OpenOffloadTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool, mtu int, queues int) ([]io.ReadWriteCloser, error) {
+	return nil, errors.New("TUN offloads are only supported on Linux")
+}
@@ -1,12 +1,42 @@
 package tun
 
 import (
+	"errors"
 	"io"
+	"unsafe"
 
 	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
 )
 
-func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool) (io.ReadWriteCloser, error) {
+// setMTU sets the MTU of interface name, it's left unchanged if mtu is not
+// positive.
+func setMTU(name string, mtu int) error {
+	if mtu <= 0 {
+		return nil
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var req struct {
+		Name [unix.IFNAMSIZ]byte
+		MTU  int32
+		pad  [0x28 - unix.IFNAMSIZ - 4]byte
+	}
+	copy(req.Name[:], name)
+	req.MTU = int32(mtu)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFMTU, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// OpenTunDevice opens a TUN device, the returned device implements
+// BatchWriter.
+func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool, mtu int) (io.ReadWriteCloser, error) {
 	cfg := water.Config{
 		DeviceType: water.TUN,
 	}
@@ -17,5 +47,48 @@ func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist boo
 		return nil, err
 	}
 	name = tunDev.Name()
-	return tunDev, nil
+	if err := setMTU(name, mtu); err != nil {
+		tunDev.Close()
+		return nil, err
+	}
+	return newBatchTunDev(tunDev), nil
+}
+
+// OpenMultiQueueTunDevice opens a TUN device with IFF_MULTI_QUEUE set and
+// attaches queues file descriptors to it. Each queue can be read and written
+// independently, packets of the same flow are always delivered to the same
+// queue by the kernel. The returned devices implement BatchWriter.
+func OpenMultiQueueTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool, mtu int, queues int) ([]io.ReadWriteCloser, error) {
+	if queues < 1 {
+		return nil, errors.New("invalid number of queues")
+	}
+
+	devs := make([]io.ReadWriteCloser, 0, queues)
+	closeAll := func() {
+		for _, dev := range devs {
+			dev.Close()
+		}
+	}
+	for i := 0; i < queues; i++ {
+		cfg := water.Config{
+			DeviceType: water.TUN,
+		}
+		cfg.Name = name
+		cfg.Persist = persist
+		cfg.MultiQueue = true
+		tunDev, err := water.New(cfg)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		// Subsequent queues must be attached to the interface created by
+		// the first one.
+		name = tunDev.Name()
+		devs = append(devs, newBatchTunDev(tunDev))
+	}
+	if err := setMTU(name, mtu); err != nil {
+		closeAll()
+		return nil, err
+	}
+	return devs, nil
 }
@@ -157,7 +157,7 @@ func getTuntapComponentId(ifaceName string) (string, string, error) {
 	return "", "", errors.New("not found component id")
 }
 
-func OpenTunDevice(name, addr, gw, mask string, dns []string, persist bool) (io.ReadWriteCloser, error) {
+func OpenTunDevice(name, addr, gw, mask string, dns []string, persist bool, mtu int) (io.ReadWriteCloser, error) {
 	componentId, devName, err := getTuntapComponentId(name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get component ID: %v", err)
@@ -170,6 +170,12 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string, persist bool) (io.
 	cmd.Run()
 	cmd = exec.Command("netsh", "interface", "ip", "set", "dns", devName, "dhcp")
 	cmd.Run()
+	if mtu > 0 {
+		cmd = exec.Command("netsh", "interface", "ipv4", "set", "subinterface", devName, fmt.Sprintf("mtu=%d", mtu), "store=active")
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("failed to set MTU: %v", err)
+		}
+	}
 	// open
 	fd, err := windows.CreateFile(
 		&devId[0],
@@ -253,7 +259,25 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string, persist bool) (io.
 		windows.Close(fd)
 		return nil, err
 	}
-	return newWinTapDev(fd, addr, gw), nil
+	return newWinTapDev(fd, addr, gw, mtu), nil
+}
+
+// OpenMultiQueueTunDevice opens the TUN device, multiple queues are only
+// supported on Linux, it fails if more than one queue is requested.
+func OpenMultiQueueTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool, mtu int, queues int) ([]io.ReadWriteCloser, error) {
+	if queues != 1 {
+		return nil, errors.New("multi-queue TUN device is only supported on Linux")
+	}
+	tunDev, err := OpenTunDevice(name, addr, gw, mask, dnsServers, persist, mtu)
+	if err != nil {
+		return nil, err
+	}
+	return []io.ReadWriteCloser{tunDev}, nil
+}
+
+// OpenOffloadTunDevice is only supported on Linux.
+func OpenOffloadTunDevice(name, addr, gw, mask string, dnsServers []string, persist bool, mtu int, queues int) ([]io.ReadWriteCloser, error) {
+	return nil, errors.New("TUN offloads are only supported on Linux")
 }
 
 type winTapDev struct {
@@ -267,14 +291,20 @@ type winTapDev struct {
 	addrIP      net.IP
 	gw          string
 	gwIP        net.IP
-	rBuf        [2048]byte
-	wBuf        [2048]byte
+	rBuf        []byte
+	wBuf        []byte
 	wInitiated  bool
 	rOverlapped windows.Overlapped
 	wOverlapped windows.Overlapped
 }
 
-func newWinTapDev(fd windows.Handle, addr string, gw string) *winTapDev {
+func newWinTapDev(fd windows.Handle, addr string, gw string, mtu int) *winTapDev {
+	// Frames carry an ethernet header.
+	bufSize := 2048
+	if mtu+14 > bufSize {
+		bufSize = mtu + 14
+	}
+
 	rOverlapped := windows.Overlapped{}
 	rEvent, _ := windows.CreateEvent(nil, 0, 0, nil)
 	rOverlapped.HEvent = windows.Handle(rEvent)
@@ -288,6 +318,8 @@ func newWinTapDev(fd windows.Handle, addr string, gw string) *winTapDev {
 		rOverlapped: rOverlapped,
 		wOverlapped: wOverlapped,
 		wInitiated:  false,
+		rBuf:        make([]byte, bufSize),
+		wBuf:        make([]byte, bufSize),
 
 		addr:   addr,
 		addrIP: net.ParseIP(addr).To4(),